@@ -0,0 +1,153 @@
+package pghelper
+
+import (
+	"fmt"
+	"github.com/linlexing/datatable.go"
+)
+
+// castMaxSize return the max size of the new column,parse it from the DBType if present
+func (p *PgMeta) castMaxSize(column *Column) int {
+	if column.DBType == "" {
+		return column.MaxSize
+	}
+	if _, maxSize, _, err := p.types().Parse(column.DBType); err == nil {
+		return maxSize
+	}
+	return 0
+}
+
+// castEmptyToNull return true if the empty string is converted to NULL by the usingCast
+func castEmptyToNull(oldColumn, newColumn *Column) bool {
+	return oldColumn.Type == datatable.String && newColumn.Type != datatable.String && newColumn.Type != datatable.Bytea
+}
+
+// usingCast return the USING expression that convert the column to the new type,
+// the colName is the quoted name of the column.
+// the NULL converted from the empty string is replaced by the NullFill of the NOT NULL column
+func (p *PgMeta) usingCast(colName string, oldColumn, newColumn *Column) string {
+	cast := p.castExpress(colName, oldColumn, newColumn)
+	if newColumn.NotNull && newColumn.NullFill != "" && castEmptyToNull(oldColumn, newColumn) {
+		return fmt.Sprintf("coalesce(%s,%s)", cast, newColumn.NullFill)
+	}
+	return cast
+}
+func (p *PgMeta) castExpress(colName string, oldColumn, newColumn *Column) string {
+	define := p.columnDefine(newColumn)
+	switch {
+	case oldColumn.Type == datatable.String && newColumn.Type == datatable.Bytea:
+		return fmt.Sprintf("convert_to(%s,'UTF8')", colName)
+	case oldColumn.Type == datatable.Bytea && newColumn.Type == datatable.String:
+		return fmt.Sprintf("convert_from(%s,'UTF8')::%s", colName, define)
+	case oldColumn.Type == datatable.String && newColumn.Type == datatable.Bool:
+		return fmt.Sprintf("nullif(lower(trim(%s)),'')::%s", colName, define)
+	case oldColumn.Type == datatable.String && newColumn.Type != datatable.String:
+		//the empty string is treated as NULL
+		return fmt.Sprintf("nullif(trim(%s),'')::%s", colName, define)
+	case (oldColumn.Type == datatable.Int64 || oldColumn.Type == datatable.Float64) && newColumn.Type == datatable.Bool:
+		return fmt.Sprintf("%s <> 0", colName)
+	case oldColumn.Type == datatable.Bool && (newColumn.Type == datatable.Int64 || newColumn.Type == datatable.Float64):
+		return fmt.Sprintf("%s::integer::%s", colName, define)
+	case oldColumn.Type == datatable.Float64 && newColumn.Type == datatable.Int64:
+		return fmt.Sprintf("trunc(%s)::%s", colName, define)
+	}
+	return fmt.Sprintf("%s::%s", colName, define)
+}
+
+// lossCondition return the condition of the rows that would be lost or fail to convert
+// when the column change to the new type,empty means no check.
+// the colName is the quoted name of the column
+func (p *PgMeta) lossCondition(colName string, oldColumn, newColumn *Column) string {
+	switch newColumn.Type {
+	case datatable.String:
+		maxSize := p.castMaxSize(newColumn)
+		if oldMaxSize := p.castMaxSize(oldColumn); maxSize == 0 ||
+			oldColumn.Type == datatable.String && oldMaxSize > 0 && oldMaxSize <= maxSize {
+			return ""
+		}
+		if oldColumn.Type == datatable.Bytea {
+			return fmt.Sprintf("length(convert_from(%s,'UTF8')) > %d", colName, maxSize)
+		}
+		return fmt.Sprintf("length(%s::text) > %d", colName, maxSize)
+	case datatable.Int64:
+		switch oldColumn.Type {
+		case datatable.String:
+			return fmt.Sprintf(`trim(%s) <> '' AND trim(%s) !~ '^[+-]?\d+$'`, colName, colName)
+		case datatable.Float64:
+			return fmt.Sprintf("%s <> trunc(%s)", colName, colName)
+		}
+	case datatable.Float64:
+		if oldColumn.Type == datatable.String {
+			return fmt.Sprintf(`trim(%s) <> '' AND trim(%s) !~* '^[+-]?(\d+\.?\d*|\.\d+)(e[+-]?\d+)?$'`, colName, colName)
+		}
+	case datatable.Bool:
+		switch oldColumn.Type {
+		case datatable.String:
+			return fmt.Sprintf("lower(trim(%s)) NOT IN ('','t','true','f','false','y','yes','n','no','on','off','1','0')", colName)
+		case datatable.Int64, datatable.Float64:
+			return fmt.Sprintf("%s NOT IN (0,1)", colName)
+		}
+	case datatable.Time:
+		switch oldColumn.Type {
+		case datatable.String:
+			//the ISO 8601 date and time,the other formats depend on the DateStyle
+			return fmt.Sprintf(`trim(%s) <> '' AND trim(%s) !~* '^\d{4}-\d{1,2}-\d{1,2}([ t]\d{1,2}:\d{1,2}(:\d{1,2}(\.\d+)?)?)?\s*(z|[+-]\d{1,2}(:?\d{2})?)?$'`, colName, colName)
+		}
+	}
+	return ""
+}
+
+// castSupported return true if the column can be converted to the new type,
+// the string convert to and from every type,the time and the bytea only to and from the string,
+// the bool only to and from the numbers
+func castSupported(oldColumn, newColumn *Column) bool {
+	if oldColumn.Type == newColumn.Type || oldColumn.Type == datatable.String || newColumn.Type == datatable.String {
+		return true
+	}
+	numeric := func(t datatable.ColumnType) bool {
+		return t == datatable.Int64 || t == datatable.Float64
+	}
+	switch {
+	case numeric(newColumn.Type):
+		return numeric(oldColumn.Type) || oldColumn.Type == datatable.Bool
+	case newColumn.Type == datatable.Bool:
+		return numeric(oldColumn.Type)
+	}
+	return false
+}
+
+// checkTypeChange count the rows that would be lost or fail to convert,
+// return the error with the row count if any,
+// the conversion that has no cast is rejected before the count
+func (p *PgMeta) checkTypeChange(tablename string, oldColumn, newColumn *Column) error {
+	if !castSupported(oldColumn, newColumn) {
+		return fmt.Errorf("change the column %q type from %s to %s not supported",
+			oldColumn.Name, p.columnDefine(oldColumn), p.columnDefine(newColumn))
+	}
+	colName := p.QuoteIdent(oldColumn.Name)
+	cond := p.lossCondition(colName, oldColumn, newColumn)
+	//the empty string converted to NULL fail the NOT NULL column
+	if newColumn.NotNull && newColumn.NullFill == "" && castEmptyToNull(oldColumn, newColumn) {
+		if cond == "" {
+			cond = fmt.Sprintf("trim(%s) = ''", colName)
+		} else {
+			cond = fmt.Sprintf("(%s OR trim(%s) = '')", cond, colName)
+		}
+	}
+	if cond == "" {
+		return nil
+	}
+	v, err := p.DBHelper.QueryOne(fmt.Sprintf("SELECT count(*) FROM %s WHERE %s IS NOT NULL AND %s",
+		p.QuoteTableName(tablename), colName, cond))
+	if err != nil {
+		return err
+	}
+	count, err := valueInt64(v)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("change the column %q type from %s to %s will lose or fail to convert %d rows",
+			oldColumn.Name, p.columnDefine(oldColumn), p.columnDefine(newColumn), count)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package pghelper
+
+import (
+	"github.com/linlexing/dbhelper"
+	"strings"
+)
+
+// Identity is the auto-increment kind of the column,
+// the values are same as the pg_attribute.attidentity except the IdentitySerial
+type Identity string
+
+const (
+	IdentityNone      Identity = ""
+	IdentityAlways    Identity = "a"
+	IdentityByDefault Identity = "d"
+	// IdentitySerial is the legacy serial/bigserial column with an owned sequence
+	IdentitySerial Identity = "s"
+)
+
+// versionIdentity is the server version that the pg_attribute has the attidentity
+const versionIdentity = 100000
+
+// identitySQL replace the attidentity of the catalog query with the empty string
+// before PostgreSQL 10,so the identity columns are read as the normal columns
+func (p *PgMeta) identitySQL(sql string) (string, error) {
+	version, err := p.ServerVersion()
+	if err != nil {
+		return "", err
+	}
+	if version < versionIdentity {
+		return strings.Replace(sql, "a.attidentity", "''::text", -1), nil
+	}
+	return sql, nil
+}
+
+// Column is the TableColumn with the PostgreSQL attributes that dbhelper not modeled
+type Column struct {
+	*dbhelper.TableColumn
+	// DBType is the catalog type of the column,e.g. numeric(12,2).
+	// empty means build the type from Type and MaxSize
+	DBType string
+	// Precision and Scale are the type modifiers,e.g. numeric(12,2) or timestamp(3)
+	Precision, Scale int
+	// Default is the DEFAULT expression,e.g. now() or nextval('seq'::regclass).
+	// empty means no default
+	Default string
+	// Identity is the auto-increment kind,the Default of the serial column is ignored
+	Identity Identity
+	// NullFill is the expression that replace the existing NULL values
+	// when the column change to NOT NULL,empty means the NULL values fail the change
+	NullFill string
+	// Sequence is the sequence owned by the identity or serial column,read only
+	Sequence string
+}
+
+// NewColumn wrap the TableColumn
+func NewColumn(column *dbhelper.TableColumn) *Column {
+	return &Column{TableColumn: column}
+}
+
+// TableColumns return the TableColumn of the columns
+func TableColumns(columns []*Column) []*dbhelper.TableColumn {
+	rev := make([]*dbhelper.TableColumn, len(columns))
+	for i, v := range columns {
+		rev[i] = v.TableColumn
+	}
+	return rev
+}
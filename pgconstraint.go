@@ -0,0 +1,403 @@
+package pghelper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the referential actions of the foreign key
+const (
+	FKNoAction   = "NO ACTION"
+	FKRestrict   = "RESTRICT"
+	FKCascade    = "CASCADE"
+	FKSetNull    = "SET NULL"
+	FKSetDefault = "SET DEFAULT"
+)
+
+// ForeignKey is the foreign key constraint of the table
+type ForeignKey struct {
+	Name    string
+	Columns []string
+	// RefTable is the referenced table,qualified with the schema when not in the current schema
+	RefTable   string
+	RefColumns []string
+	// OnDelete and OnUpdate are the referential actions,empty means NO ACTION
+	OnDelete, OnUpdate string
+	Deferrable         bool
+	InitiallyDeferred  bool
+	// NotValid create the constraint without checking the existing rows,
+	// use ValidateConstraint to check them later.
+	// when read from the database,it means the constraint is not validated yet
+	NotValid bool
+}
+
+var fkActions = map[string]string{
+	"a": FKNoAction,
+	"r": FKRestrict,
+	"c": FKCascade,
+	"n": FKSetNull,
+	"d": FKSetDefault,
+}
+
+func (p *PgMeta) foreignKeyDefine(fk *ForeignKey) string {
+	rev := fmt.Sprintf("CONSTRAINT %s FOREIGN KEY(%s) REFERENCES %s(%s)",
+		p.QuoteIdent(fk.Name), strings.Join(p.QuoteIdents(fk.Columns), ","),
+		p.QuoteTableName(fk.RefTable), strings.Join(p.QuoteIdents(fk.RefColumns), ","))
+	if fk.OnDelete != "" && fk.OnDelete != FKNoAction {
+		rev += " ON DELETE " + fk.OnDelete
+	}
+	if fk.OnUpdate != "" && fk.OnUpdate != FKNoAction {
+		rev += " ON UPDATE " + fk.OnUpdate
+	}
+	rev += deferrableDefine(fk.Deferrable, fk.InitiallyDeferred)
+	if fk.NotValid {
+		rev += " NOT VALID"
+	}
+	return rev
+}
+func deferrableDefine(deferrable, initiallyDeferred bool) string {
+	switch {
+	case deferrable && initiallyDeferred:
+		return " DEFERRABLE INITIALLY DEFERRED"
+	case deferrable:
+		return " DEFERRABLE INITIALLY IMMEDIATE"
+	default:
+		return " NOT DEFERRABLE"
+	}
+}
+
+// GetForeignKeys return the foreign keys of the table
+func (p *PgMeta) GetForeignKeys(tablename string) ([]*ForeignKey, error) {
+	table, err := p.DBHelper.GetData(SQL_TableForeignKeys, p.QuoteTableName(tablename))
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]*ForeignKey, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		rev[i] = foreignKeyFromRow(table.Row(i))
+	}
+	return rev, nil
+}
+
+// foreignKeyFromRow build the foreign key from the row of the SQL_TableForeignKeys
+func foreignKeyFromRow(row map[string]interface{}) *ForeignKey {
+	rev := &ForeignKey{
+		Name:              row["name"].(string),
+		Columns:           strings.Split(row["columns"].(string), ","),
+		RefTable:          row["ref_table"].(string),
+		RefColumns:        strings.Split(row["ref_columns"].(string), ","),
+		OnDelete:          fkActions[row["on_delete"].(string)],
+		OnUpdate:          fkActions[row["on_update"].(string)],
+		Deferrable:        row["deferrable"].(bool),
+		InitiallyDeferred: row["deferred"].(bool),
+		NotValid:          !row["validated"].(bool),
+	}
+	if schema := row["ref_schema"].(string); schema != "" {
+		rev.RefTable = schema + "." + rev.RefTable
+	}
+	return rev
+}
+
+// AddForeignKey add the foreign key to the table,
+// set the NotValid to avoid the long lock of checking the existing rows on the large table
+func (p *PgMeta) AddForeignKey(tablename string, fk *ForeignKey) error {
+	return p.exec(fmt.Sprintf("add the foreign key %q of the table %q", fk.Name, tablename),
+		fmt.Sprintf("ALTER TABLE %s ADD %s", p.QuoteTableName(tablename), p.foreignKeyDefine(fk)), false)
+}
+
+// DropForeignKey drop the foreign key of the table
+func (p *PgMeta) DropForeignKey(tablename, fkname string) error {
+	return p.DropConstraint(tablename, fkname)
+}
+
+// DropConstraint drop the constraint of the table
+func (p *PgMeta) DropConstraint(tablename, name string) error {
+	return p.exec(fmt.Sprintf("drop the constraint %q of the table %q", name, tablename),
+		fmt.Sprintf(SQL_DropConstraint, p.QuoteTableName(tablename), p.QuoteIdent(name)), true)
+}
+
+// ValidateConstraint check the existing rows of the constraint created with NOT VALID
+func (p *PgMeta) ValidateConstraint(tablename, name string) error {
+	return p.exec(fmt.Sprintf("validate the constraint %q of the table %q", name, tablename),
+		fmt.Sprintf(SQL_ValidateConstraint, p.QuoteTableName(tablename), p.QuoteIdent(name)), false)
+}
+
+// AlterForeignKey change the foreign key,only the deferrability is altered in place,
+// otherwise the foreign key is dropped and added as NOT VALID in a transaction then validated,
+// unless the newFK asks to keep it not valid
+func (p *PgMeta) AlterForeignKey(tablename string, oldFK, newFK *ForeignKey) error {
+	if oldFK.Name == newFK.Name &&
+		strings.Join(oldFK.Columns, ",") == strings.Join(newFK.Columns, ",") &&
+		oldFK.RefTable == newFK.RefTable &&
+		strings.Join(oldFK.RefColumns, ",") == strings.Join(newFK.RefColumns, ",") &&
+		fkAction(oldFK.OnDelete) == fkAction(newFK.OnDelete) &&
+		fkAction(oldFK.OnUpdate) == fkAction(newFK.OnUpdate) {
+		if oldFK.Deferrable != newFK.Deferrable || oldFK.InitiallyDeferred != newFK.InitiallyDeferred {
+			if err := p.exec(fmt.Sprintf("alter the foreign key %q deferrable", newFK.Name),
+				fmt.Sprintf("ALTER TABLE %s ALTER CONSTRAINT %s%s", p.QuoteTableName(tablename),
+					p.QuoteIdent(newFK.Name), deferrableDefine(newFK.Deferrable, newFK.InitiallyDeferred)), false); err != nil {
+				return err
+			}
+		}
+		if oldFK.NotValid && !newFK.NotValid {
+			return p.ValidateConstraint(tablename, newFK.Name)
+		}
+		return nil
+	}
+	tname := p.QuoteTableName(tablename)
+	fk := *newFK
+	fk.NotValid = true
+	batch := &ddlBatch{}
+	batch.addDestructive(fmt.Sprintf("drop the constraint %q of the table %q", oldFK.Name, tablename),
+		fmt.Sprintf(SQL_DropConstraint, tname, p.QuoteIdent(oldFK.Name)))
+	batch.add(fmt.Sprintf("add the foreign key %q of the table %q", fk.Name, tablename),
+		fmt.Sprintf("ALTER TABLE %s ADD %s", tname, p.foreignKeyDefine(&fk)))
+	if err := p.execBatch(batch, false); err != nil {
+		return err
+	}
+	if !newFK.NotValid {
+		return p.ValidateConstraint(tablename, newFK.Name)
+	}
+	return nil
+}
+func fkAction(action string) string {
+	if action == "" {
+		return FKNoAction
+	}
+	return action
+}
+
+// CheckConstraint is the CHECK constraint of the table
+type CheckConstraint struct {
+	Name string
+	// Expression is the boolean expression,e.g. (price > 0)
+	Expression string
+	// NotValid create the constraint without checking the existing rows,
+	// when read from the database,it means the constraint is not validated yet
+	NotValid bool
+}
+
+// UniqueConstraint is the UNIQUE constraint of the table,
+// it differ from the unique index by can be deferrable and referenced by the foreign key
+type UniqueConstraint struct {
+	Name              string
+	Columns           []string
+	Deferrable        bool
+	InitiallyDeferred bool
+}
+
+func (p *PgMeta) checkDefine(check *CheckConstraint) string {
+	rev := fmt.Sprintf("CONSTRAINT %s CHECK (%s)", p.QuoteIdent(check.Name), check.Expression)
+	if check.NotValid {
+		rev += " NOT VALID"
+	}
+	return rev
+}
+func (p *PgMeta) uniqueDefine(unique *UniqueConstraint) string {
+	return fmt.Sprintf("CONSTRAINT %s UNIQUE(%s)%s", p.QuoteIdent(unique.Name),
+		strings.Join(p.QuoteIdents(unique.Columns), ","), deferrableDefine(unique.Deferrable, unique.InitiallyDeferred))
+}
+
+// GetCheckConstraints return the CHECK constraints of the table
+func (p *PgMeta) GetCheckConstraints(tablename string) ([]*CheckConstraint, error) {
+	table, err := p.DBHelper.GetData(SQL_TableConstraints, p.QuoteTableName(tablename), "c")
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]*CheckConstraint, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		rev[i] = checkFromRow(table.Row(i))
+	}
+	return rev, nil
+}
+
+// checkFromRow build the CHECK constraint from the row of the SQL_TableConstraints
+func checkFromRow(row map[string]interface{}) *CheckConstraint {
+	return &CheckConstraint{
+		Name:       row["name"].(string),
+		Expression: row["expression"].(string),
+		NotValid:   !row["validated"].(bool),
+	}
+}
+
+// GetUniqueConstraints return the UNIQUE constraints of the table,
+// the unique indexes created by CreateIndex are not included
+func (p *PgMeta) GetUniqueConstraints(tablename string) ([]*UniqueConstraint, error) {
+	table, err := p.DBHelper.GetData(SQL_TableConstraints, p.QuoteTableName(tablename), "u")
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]*UniqueConstraint, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		rev[i] = uniqueFromRow(table.Row(i))
+	}
+	return rev, nil
+}
+
+// uniqueFromRow build the UNIQUE constraint from the row of the SQL_TableConstraints
+func uniqueFromRow(row map[string]interface{}) *UniqueConstraint {
+	return &UniqueConstraint{
+		Name:              row["name"].(string),
+		Columns:           strings.Split(row["columns"].(string), ","),
+		Deferrable:        row["deferrable"].(bool),
+		InitiallyDeferred: row["deferred"].(bool),
+	}
+}
+
+// AddCheckConstraint add the CHECK constraint to the table
+func (p *PgMeta) AddCheckConstraint(tablename string, check *CheckConstraint) error {
+	return p.exec(fmt.Sprintf("add the check constraint %q of the table %q", check.Name, tablename),
+		fmt.Sprintf("ALTER TABLE %s ADD %s", p.QuoteTableName(tablename), p.checkDefine(check)), false)
+}
+
+// AddUniqueConstraint add the UNIQUE constraint to the table
+func (p *PgMeta) AddUniqueConstraint(tablename string, unique *UniqueConstraint) error {
+	return p.exec(fmt.Sprintf("add the unique constraint %q of the table %q", unique.Name, tablename),
+		fmt.Sprintf("ALTER TABLE %s ADD %s", p.QuoteTableName(tablename), p.uniqueDefine(unique)), false)
+}
+
+// AlterCheckConstraint replace the CHECK constraint,the old one is dropped and the new one is added
+// as NOT VALID in a transaction then validated,unless the newCheck asks to keep it not valid
+func (p *PgMeta) AlterCheckConstraint(tablename string, oldCheck, newCheck *CheckConstraint) error {
+	if oldCheck.Name == newCheck.Name && oldCheck.Expression == newCheck.Expression {
+		if oldCheck.NotValid && !newCheck.NotValid {
+			return p.ValidateConstraint(tablename, newCheck.Name)
+		}
+		return nil
+	}
+	tname := p.QuoteTableName(tablename)
+	check := *newCheck
+	check.NotValid = true
+	batch := &ddlBatch{}
+	batch.addDestructive(fmt.Sprintf("drop the constraint %q of the table %q", oldCheck.Name, tablename),
+		fmt.Sprintf(SQL_DropConstraint, tname, p.QuoteIdent(oldCheck.Name)))
+	batch.add(fmt.Sprintf("add the check constraint %q of the table %q", check.Name, tablename),
+		fmt.Sprintf("ALTER TABLE %s ADD %s", tname, p.checkDefine(&check)))
+	if err := p.execBatch(batch, false); err != nil {
+		return err
+	}
+	if !newCheck.NotValid {
+		return p.ValidateConstraint(tablename, newCheck.Name)
+	}
+	return nil
+}
+
+// AlterUniqueConstraint replace the UNIQUE constraint,the old one is dropped and the new one is added
+// in a transaction.the deferrability is changed the same way,
+// the ALTER CONSTRAINT only supports the foreign key
+func (p *PgMeta) AlterUniqueConstraint(tablename string, oldUnique, newUnique *UniqueConstraint) error {
+	if oldUnique.Name == newUnique.Name &&
+		strings.Join(oldUnique.Columns, ",") == strings.Join(newUnique.Columns, ",") &&
+		oldUnique.Deferrable == newUnique.Deferrable && oldUnique.InitiallyDeferred == newUnique.InitiallyDeferred {
+		return nil
+	}
+	tname := p.QuoteTableName(tablename)
+	batch := &ddlBatch{}
+	batch.addDestructive(fmt.Sprintf("drop the constraint %q of the table %q", oldUnique.Name, tablename),
+		fmt.Sprintf(SQL_DropConstraint, tname, p.QuoteIdent(oldUnique.Name)))
+	batch.add(fmt.Sprintf("add the unique constraint %q of the table %q", newUnique.Name, tablename),
+		fmt.Sprintf("ALTER TABLE %s ADD %s", tname, p.uniqueDefine(newUnique)))
+	return p.execBatch(batch, false)
+}
+
+// CheckRule is the check rule of the table saved in the lx_check table,
+// the rule is checked by the application,not the database
+type CheckRule struct {
+	ID           string
+	DisplayLabel string
+	Level        int64
+	Fields       []string
+	Script       string
+	Grade        int64
+}
+
+// GetCheckRules return the check rules of the table saved in the lx_check table,
+// return empty if the lx_check table not exists
+func (p *PgMeta) GetCheckRules(tablename string) ([]*CheckRule, error) {
+	if exists, err := p.TableExists("lx_check"); err != nil || !exists {
+		return nil, err
+	}
+	table, err := p.DBHelper.GetData(SQL_GetTableCheck, tablename)
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]*CheckRule, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		row := table.Row(i)
+		rev[i] = &CheckRule{
+			ID:           valueString(row["id"]),
+			DisplayLabel: valueString(row["displaylabel"]),
+			Script:       valueString(row["script"]),
+		}
+		if fields := valueString(row["fields"]); fields != "" {
+			rev[i].Fields = strings.Split(fields, ",")
+		}
+		if rev[i].Level, err = valueInt64(row["level"]); err != nil {
+			return nil, fmt.Errorf("the check %q level invalid:%s", rev[i].ID, err)
+		}
+		if rev[i].Grade, err = valueInt64(row["grade"]); err != nil {
+			return nil, fmt.Errorf("the check %q grade invalid:%s", rev[i].ID, err)
+		}
+	}
+	return rev, nil
+}
+
+// SaveCheckRule insert or update the check rule of the table in the lx_check table,
+// the rule is matched by the ID
+func (p *PgMeta) SaveCheckRule(tablename string, rule *CheckRule) error {
+	if exists, err := p.TableExists("lx_check"); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("the table lx_check not exists")
+	}
+	args := []interface{}{tablename, rule.ID, rule.DisplayLabel, rule.Level,
+		strings.Join(rule.Fields, ","), rule.Script, rule.Grade}
+	rs, err := p.DBHelper.Exec(SQL_UpdateTableCheck, args...)
+	if err != nil {
+		return fmt.Errorf("update the check %q of the table %q fail:%s", rule.ID, tablename, err)
+	}
+	if count, err := rs.RowsAffected(); err != nil {
+		return err
+	} else if count > 0 {
+		return nil
+	}
+	if _, err := p.DBHelper.Exec(SQL_InsertTableCheck, args...); err != nil {
+		return fmt.Errorf("insert the check %q of the table %q fail:%s", rule.ID, tablename, err)
+	}
+	return nil
+}
+
+// DeleteCheckRule delete the check rule of the table from the lx_check table,
+// return nil if the lx_check table or the rule not exists
+func (p *PgMeta) DeleteCheckRule(tablename, id string) error {
+	if exists, err := p.TableExists("lx_check"); err != nil || !exists {
+		return err
+	}
+	if _, err := p.DBHelper.Exec(SQL_DeleteTableCheck, tablename, id); err != nil {
+		return fmt.Errorf("delete the check %q of the table %q fail:%s", id, tablename, err)
+	}
+	return nil
+}
+func valueString(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return tv
+	case []byte:
+		return string(tv)
+	default:
+		return fmt.Sprint(tv)
+	}
+}
+func valueInt64(v interface{}) (int64, error) {
+	switch tv := v.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return tv, nil
+	default:
+		return strconv.ParseInt(valueString(tv), 10, 64)
+	}
+}
@@ -0,0 +1,450 @@
+package pghelper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/linlexing/datatable.go"
+	"github.com/linlexing/dbhelper"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// CopySource return the next row of the CopyInSource in the order of the columns,
+// return io.EOF after the last row
+type CopySource func() ([]interface{}, error)
+
+// copyInSQL return the COPY FROM STDIN statement of the lib/pq
+func copyInSQL(tablename string, columns []string) string {
+	if schema, table := splitTableName(tablename); schema != "" {
+		return pq.CopyInSchema(schema, table, columns...)
+	}
+	return pq.CopyIn(tablename, columns...)
+}
+
+// tableSource return the rows of the table as the CopySource
+func tableSource(rows *dbhelper.DataTable) CopySource {
+	i := 0
+	return func() ([]interface{}, error) {
+		if i >= rows.RowCount() {
+			return nil, io.EOF
+		}
+		row := rows.Row(i)
+		i++
+		values := make([]interface{}, len(rows.Columns))
+		for j, v := range rows.Columns {
+			values[j] = row[v.Name]
+		}
+		return values, nil
+	}
+}
+
+// CopyIn load the rows of the data into the table by the COPY protocol in a transaction,
+// the columns of the data are matched to the table columns by the name
+func (p *PgMeta) CopyIn(tablename string, data *dbhelper.DataTable) error {
+	_, err := p.CopyInSource(tablename, data.Columns, tableSource(data))
+	return err
+}
+
+// CopyInSource stream the rows of the source into the table by the COPY protocol in a transaction,
+// the rows are not buffered.the values are converted by the datatable type of the columns,
+// the same type used by the getColumnDefine.return the count of the loaded rows
+func (p *PgMeta) CopyInSource(tablename string, columns []*dbhelper.DataColumn, source CopySource) (int64, error) {
+	if err := p.DBHelper.Begin(); err != nil {
+		return 0, err
+	}
+	count, err := p.copyIn(tablename, columns, source)
+	if err != nil {
+		if rbErr := p.DBHelper.Rollback(); rbErr != nil {
+			return 0, fmt.Errorf("copy into %q fail:%s,and rollback fail:%s", tablename, err, rbErr)
+		}
+		return 0, fmt.Errorf("copy into %q fail:%s", tablename, err)
+	}
+	return count, p.DBHelper.Commit()
+}
+
+// copyRows load the rows into the table by the COPY protocol,it must run in a transaction
+func (p *PgMeta) copyRows(tablename string, rows *dbhelper.DataTable) error {
+	_, err := p.copyIn(tablename, rows.Columns, tableSource(rows))
+	return err
+}
+
+// copyIn run the COPY of the source,it must run in a transaction
+func (p *PgMeta) copyIn(tablename string, columns []*dbhelper.DataColumn, source CopySource) (int64, error) {
+	names := make([]string, len(columns))
+	for i, v := range columns {
+		names[i] = v.Name
+	}
+	stmt, err := p.DBHelper.Prepare(copyInSQL(tablename, names))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	values := make([]interface{}, len(columns))
+	var count int64
+	for {
+		row, err := source()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if len(row) != len(columns) {
+			return count, fmt.Errorf("the row %d has %d values,the columns is %d", count+1, len(row), len(columns))
+		}
+		for i, v := range columns {
+			if values[i], err = copyValue(v.DataType, row[i]); err != nil {
+				return count, fmt.Errorf("the row %d column %q:%s", count+1, v.Name, err)
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return count, err
+		}
+		count++
+	}
+	//flush the buffered rows
+	_, err = stmt.Exec()
+	return count, err
+}
+
+// copyValue convert the value to the go type that the lib/pq encode as the column type.
+// the lib/pq encode the []byte as the bytea,so it is converted to the string for the other types.
+// the string is passed as is to the non-string column,the server parse it
+func copyValue(dataType datatable.ColumnType, value interface{}) (interface{}, error) {
+	switch tv := value.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		if dataType == datatable.Bytea {
+			return tv, nil
+		}
+		return string(tv), nil
+	case string:
+		if dataType == datatable.Bytea {
+			return []byte(tv), nil
+		}
+		return tv, nil
+	}
+	switch dataType {
+	case datatable.String:
+		if tv, ok := value.(time.Time); ok {
+			return tv.Format(time.RFC3339Nano), nil
+		}
+		return fmt.Sprint(value), nil
+	case datatable.Bool:
+		switch tv := value.(type) {
+		case bool:
+			return tv, nil
+		case int64:
+			return tv != 0, nil
+		case int:
+			return tv != 0, nil
+		}
+	case datatable.Int64:
+		switch tv := value.(type) {
+		case int64:
+			return tv, nil
+		case int:
+			return int64(tv), nil
+		case int32:
+			return int64(tv), nil
+		case float64:
+			if tv == math.Trunc(tv) {
+				return int64(tv), nil
+			}
+		case bool:
+			if tv {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case datatable.Float64:
+		switch tv := value.(type) {
+		case float64:
+			return tv, nil
+		case float32:
+			return float64(tv), nil
+		case int64:
+			return float64(tv), nil
+		case int:
+			return float64(tv), nil
+		case int32:
+			return float64(tv), nil
+		}
+	case datatable.Time:
+		if tv, ok := value.(time.Time); ok {
+			return tv, nil
+		}
+	}
+	return nil, fmt.Errorf("the value %v(%T) can not convert to %s", value, value, dataType)
+}
+
+// CopyType is the format of the CopyOut
+type CopyType string
+
+const (
+	CopyText   CopyType = "text"
+	CopyCSV    CopyType = "csv"
+	CopyBinary CopyType = "binary"
+)
+
+// CopyFormat describe the output of the CopyOut like the options of the COPY TO
+type CopyFormat struct {
+	// Type default to the CopyText
+	Type CopyType
+	// Header write the column names as the first line,csv only
+	Header bool
+	// Delimiter default to the tab of the text and the comma of the csv
+	Delimiter rune
+	// Null is the string of the NULL value,
+	// empty means the default of the format(\N of the text,the unquoted empty string of the csv)
+	Null string
+}
+
+// the rows fetched from the cursor at a time by the CopyOut
+const copyFetchSize = 1000
+
+var regCopyQuery = regexp.MustCompile(`(?i)^\s*(\(|select\s|with\s|values\s|table\s)`)
+
+// stripComments remove the leading spaces and comments of the query,the block comments may be nested
+func stripComments(query string) string {
+	for {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(query, "--"):
+			if i := strings.IndexByte(query, '\n'); i >= 0 {
+				query = query[i+1:]
+			} else {
+				return ""
+			}
+		case strings.HasPrefix(query, "/*"):
+			depth := 0
+			i := 0
+			for ; i < len(query); i++ {
+				if strings.HasPrefix(query[i:], "/*") {
+					depth++
+					i++
+				} else if strings.HasPrefix(query[i:], "*/") {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if depth > 0 {
+				return ""
+			}
+			query = query[i+1:]
+		default:
+			return query
+		}
+	}
+}
+
+// copyBinaryHeader is the signature,the flags and the header extension length of the binary COPY
+var copyBinaryHeader = []byte("PGCOPY\n\377\r\n\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+// CopyOut write the rows of the query or the table to the writer in the format of the COPY TO STDOUT,
+// the lib/pq not support the COPY TO,so the rows are read from a cursor by the batches and
+// the values are converted by the output(text,csv) or the send(binary) function of the column type,
+// the same used by the COPY.the result set is never buffered.return the count of the written rows
+func (p *PgMeta) CopyOut(query string, writer io.Writer, format *CopyFormat) (int64, error) {
+	f := CopyFormat{}
+	if format != nil {
+		f = *format
+	}
+	switch f.Type {
+	case "":
+		f.Type = CopyText
+	case CopyText, CopyCSV:
+	case CopyBinary:
+		if f.Header || f.Delimiter != 0 || f.Null != "" {
+			return 0, fmt.Errorf("the binary format can not have the header,delimiter or null")
+		}
+	default:
+		return 0, fmt.Errorf("the copy format %q invalid", f.Type)
+	}
+	if f.Header && f.Type != CopyCSV {
+		return 0, fmt.Errorf("the header is available only in the csv format")
+	}
+	if f.Delimiter == 0 {
+		if f.Type == CopyCSV {
+			f.Delimiter = ','
+		} else {
+			f.Delimiter = '\t'
+		}
+	}
+	if f.Null == "" && f.Type == CopyText {
+		f.Null = `\N`
+	}
+	if !regCopyQuery.MatchString(stripComments(query)) {
+		query = "SELECT * FROM " + p.QuoteTableName(query)
+	}
+	if err := p.DBHelper.Begin(); err != nil {
+		return 0, err
+	}
+	count, err := p.copyOut(query, writer, &f)
+	//the cursor is closed by the rollback,nothing is changed
+	if rbErr := p.DBHelper.Rollback(); rbErr != nil && err == nil {
+		err = rbErr
+	}
+	if err != nil {
+		return count, fmt.Errorf("copy out fail:%s", err)
+	}
+	return count, nil
+}
+
+// copyOut declare the cursor of the query and write the rows,it must run in a transaction.
+// no temporary object is created,so it run on the read-only standby too
+func (p *PgMeta) copyOut(query string, writer io.Writer, f *CopyFormat) (int64, error) {
+	//the query end with the new line,so the trailing comment not hide the rest of the wrapper
+	query += "\n"
+	header, err := p.DBHelper.GetData(fmt.Sprintf("SELECT * FROM (%s) q LIMIT 0", query))
+	if err != nil {
+		return 0, err
+	}
+	//the columns are renamed by the position,the duplicate or unnamed columns are valid
+	names := make([]string, len(header.Columns))
+	aliases := make([]string, len(header.Columns))
+	types := make([]string, len(header.Columns))
+	for i, v := range header.Columns {
+		names[i] = v.Name
+		aliases[i] = fmt.Sprintf("c%d", i)
+		types[i] = fmt.Sprintf("pg_typeof(q.c%d)", i)
+	}
+	columns, err := p.DBHelper.GetData(fmt.Sprintf(SQL_CopyOutColumns,
+		strings.Join(types, ","), query, strings.Join(aliases, ",")))
+	if err != nil {
+		return 0, err
+	}
+	if columns.RowCount() != len(names) {
+		return 0, fmt.Errorf("the query has %d columns,got %d types", len(names), columns.RowCount())
+	}
+	values := make([]string, len(names))
+	for i := range names {
+		row := columns.Row(i)
+		if f.Type == CopyBinary {
+			values[i] = fmt.Sprintf("%s(q.c%d) AS c%d", valueString(row["send"]), i, i)
+		} else {
+			values[i] = fmt.Sprintf("%s(q.c%d)::text AS c%d", valueString(row["output"]), i, i)
+		}
+	}
+	if _, err := p.DBHelper.Exec(fmt.Sprintf("DECLARE pghelper_copy NO SCROLL CURSOR FOR SELECT %s FROM (%s) q(%s)",
+		strings.Join(values, ","), query, strings.Join(aliases, ","))); err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(writer)
+	if f.Type == CopyBinary {
+		w.Write(copyBinaryHeader)
+	} else if f.Header {
+		writeCopyLine(w, names, f)
+	}
+	var count int64
+	line := make([]interface{}, len(names))
+	for {
+		table, err := p.DBHelper.GetData(fmt.Sprintf("FETCH %d FROM pghelper_copy", copyFetchSize))
+		if err != nil {
+			return count, err
+		}
+		for i := 0; i < table.RowCount(); i++ {
+			row := table.Row(i)
+			for j := range line {
+				line[j] = row[fmt.Sprintf("c%d", j)]
+			}
+			if f.Type == CopyBinary {
+				writeCopyBinary(w, line)
+			} else {
+				fields := make([]string, len(line))
+				for j, v := range line {
+					if v == nil {
+						fields[j] = f.Null
+					} else {
+						fields[j] = copyField(valueString(v), f)
+					}
+				}
+				w.WriteString(strings.Join(fields, string(f.Delimiter)))
+				w.WriteByte('\n')
+			}
+			count++
+		}
+		//write the batch,so the rows are not kept in memory
+		if err := w.Flush(); err != nil {
+			return count, err
+		}
+		if table.RowCount() < copyFetchSize {
+			break
+		}
+	}
+	if f.Type == CopyBinary {
+		//the file trailer
+		binary.Write(w, binary.BigEndian, int16(-1))
+	}
+	return count, w.Flush()
+}
+
+// writeCopyLine write the header line of the csv
+func writeCopyLine(w *bufio.Writer, values []string, f *CopyFormat) {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		fields[i] = copyField(v, f)
+	}
+	w.WriteString(strings.Join(fields, string(f.Delimiter)))
+	w.WriteByte('\n')
+}
+
+// writeCopyBinary write a tuple of the binary COPY,the values are the bytes of the send function
+func writeCopyBinary(w *bufio.Writer, values []interface{}) {
+	binary.Write(w, binary.BigEndian, int16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			binary.Write(w, binary.BigEndian, int32(-1))
+			continue
+		}
+		var data []byte
+		switch tv := v.(type) {
+		case []byte:
+			data = tv
+		default:
+			data = []byte(valueString(tv))
+		}
+		binary.Write(w, binary.BigEndian, int32(len(data)))
+		w.Write(data)
+	}
+}
+
+// copyField escape the not null value of the text or csv format like the COPY TO
+func copyField(value string, f *CopyFormat) string {
+	if f.Type == CopyCSV {
+		//the value equal to the null string is quoted,so it is not read as NULL
+		if value == f.Null || strings.ContainsAny(value, string(f.Delimiter)+"\"\r\n") {
+			return `"` + strings.Replace(value, `"`, `""`, -1) + `"`
+		}
+		return value
+	}
+	var b strings.Builder
+	for _, c := range value {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case f.Delimiter:
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package pghelper
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PlanStep is a statement of the DDL plan
+type PlanStep struct {
+	// Desc is the human-readable description,it names the step in the error
+	Desc string
+	SQL  string
+	// Destructive means the step drop or rewrite the existing data or objects
+	Destructive bool
+	// Batch number the steps recorded together,the steps of a batch are applied all or nothing
+	Batch int
+	// InCallerTx means the batch run without its own transaction,see the execBatch
+	InCallerTx bool
+	// Backfill is set on the backfill of the online type change,
+	// it is run by the batches of the rows instead of the SQL that show the whole UPDATE
+	Backfill *Backfill
+	// InvalidIndex is set on the step that drop the index only if it is invalid,
+	// it is run by the catalog check instead of the SQL
+	InvalidIndex *InvalidIndex
+	// Cleanup are the steps run when the batch fail,they drop the objects left by the failed batch
+	Cleanup []*PlanStep
+}
+
+// Backfill is the batched UPDATE of the shadow column,see the changeTypeOnline
+type Backfill struct {
+	// Table and Shadow are quoted,the Cast read the old column of the table aliased as dest
+	Table  string
+	Keys   []string
+	Shadow string
+	Cast   string
+	// Size is the rows updated by a statement
+	Size int
+}
+
+// InvalidIndex is the index left by the failed CREATE INDEX CONCURRENTLY
+type InvalidIndex struct {
+	Table string
+	Name  string
+}
+
+// Plan is the ordered DDL statements recorded by the PgMeta in the dry-run mode
+type Plan struct {
+	Steps []*PlanStep
+}
+
+// Destructive return true if any step is destructive
+func (p *Plan) Destructive() bool {
+	for _, v := range p.Steps {
+		if v.Destructive {
+			return true
+		}
+	}
+	return false
+}
+
+// String return the plan as a SQL script,the description of the step is written as the comment
+func (p *Plan) String() string {
+	var b bytes.Buffer
+	for _, v := range p.Steps {
+		if v.Destructive {
+			fmt.Fprintf(&b, "-- %s (destructive)\n", v.Desc)
+		} else {
+			fmt.Fprintf(&b, "-- %s\n", v.Desc)
+		}
+		fmt.Fprintf(&b, "%s;\n", v.SQL)
+	}
+	return b.String()
+}
+
+// ddlBatch collect the structural changes of a table,so they are applied all or nothing
+type ddlBatch struct {
+	steps   []*PlanStep
+	cleanup []*PlanStep
+}
+
+func (b *ddlBatch) add(desc, sql string) {
+	b.steps = append(b.steps, &PlanStep{Desc: desc, SQL: sql})
+}
+
+// addDestructive add the step that drop or rewrite the existing data or objects
+func (b *ddlBatch) addDestructive(desc, sql string) {
+	b.steps = append(b.steps, &PlanStep{Desc: desc, SQL: sql, Destructive: true})
+}
+
+// addCleanup add the step run when the batch fail
+func (b *ddlBatch) addCleanup(desc, sql string) {
+	b.cleanup = append(b.cleanup, &PlanStep{Desc: desc, SQL: sql})
+}
+
+// exec run the single statement,or record it in the dry-run mode
+func (p *PgMeta) exec(desc, sql string, destructive bool) error {
+	return p.execBatch(&ddlBatch{steps: []*PlanStep{{Desc: desc, SQL: sql, Destructive: destructive}}}, false)
+}
+
+// execBatch run the steps in a transaction,the error name the failing step.
+// the batch with a temporary table run in the caller's transaction,
+// otherwise the ON COMMIT DROP table is dropped by our commit.
+// the cleanup steps run if the batch fail.
+// with the Plan set,the steps are appended to the plan and not executed
+func (p *PgMeta) execBatch(batch *ddlBatch, inCallerTx bool) error {
+	if p.Plan != nil {
+		no := 1
+		if n := len(p.Plan.Steps); n > 0 {
+			no = p.Plan.Steps[n-1].Batch + 1
+		}
+		for _, v := range batch.steps {
+			v.Batch = no
+			v.InCallerTx = inCallerTx
+			v.Cleanup = batch.cleanup
+		}
+		p.Plan.Steps = append(p.Plan.Steps, batch.steps...)
+		return nil
+	}
+	return p.runCleanup(p.runSteps(batch.steps, inCallerTx), batch.cleanup)
+}
+
+// runCleanup run the cleanup steps one by one if the err is not nil,return the err with the cleanup errors
+func (p *PgMeta) runCleanup(err error, cleanup []*PlanStep) error {
+	if err == nil {
+		return nil
+	}
+	for _, v := range cleanup {
+		if cleanErr := p.runStep(v); cleanErr != nil {
+			err = fmt.Errorf("%s,and %s fail:%s", err, v.Desc, cleanErr)
+		}
+	}
+	return err
+}
+
+// runStep execute the SQL of the step,or the backfill and the invalid index check
+func (p *PgMeta) runStep(step *PlanStep) error {
+	switch {
+	case step.Backfill != nil:
+		b := step.Backfill
+		return p.backfillShadow(b.Table, b.Keys, b.Shadow, b.Cast, b.Size)
+	case step.InvalidIndex != nil:
+		names, err := p.invalidIndexes(step.InvalidIndex.Table, step.InvalidIndex.Name)
+		if err != nil {
+			return err
+		}
+		for _, v := range names {
+			if _, err := p.DBHelper.Exec(fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", p.quoteIndexName(step.InvalidIndex.Table, v))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, err := p.DBHelper.Exec(step.SQL)
+	return err
+}
+func (p *PgMeta) runSteps(steps []*PlanStep, inCallerTx bool) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	if len(steps) == 1 || inCallerTx {
+		for _, v := range steps {
+			if err := p.runStep(v); err != nil {
+				return fmt.Errorf("%s fail:%s", v.Desc, err)
+			}
+		}
+		return nil
+	}
+	if err := p.DBHelper.Begin(); err != nil {
+		return err
+	}
+	for _, v := range steps {
+		if err := p.runStep(v); err != nil {
+			if rbErr := p.DBHelper.Rollback(); rbErr != nil {
+				return fmt.Errorf("%s fail:%s,and rollback fail:%s", v.Desc, err, rbErr)
+			}
+			return fmt.Errorf("%s fail:%s", v.Desc, err)
+		}
+	}
+	return p.DBHelper.Commit()
+}
+
+// ApplyPlan execute the recorded plan as is.each batch run the same way as it is recorded,
+// so the single statement like the CREATE INDEX CONCURRENTLY run without a transaction,
+// the backfill run by the batches of the rows and the cleanup steps run if the batch fail
+func (p *PgMeta) ApplyPlan(plan *Plan) error {
+	for begin := 0; begin < len(plan.Steps); {
+		end := begin + 1
+		for end < len(plan.Steps) && plan.Steps[end].Batch == plan.Steps[begin].Batch {
+			end++
+		}
+		if err := p.runCleanup(p.runSteps(plan.Steps[begin:end], plan.Steps[begin].InCallerTx), plan.Steps[begin].Cleanup); err != nil {
+			return err
+		}
+		begin = end
+	}
+	return nil
+}
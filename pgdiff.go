@@ -0,0 +1,415 @@
+package pghelper
+
+import (
+	"fmt"
+	"github.com/linlexing/dbhelper"
+	"sort"
+	"strings"
+)
+
+// DiffKind is the kind of the schema change
+type DiffKind string
+
+const (
+	DiffAdded   DiffKind = "added"
+	DiffRemoved DiffKind = "removed"
+	DiffChanged DiffKind = "changed"
+)
+
+// the objects of the schema change
+const (
+	DiffTable      = "table"
+	DiffComment    = "comment"
+	DiffColumn     = "column"
+	DiffPrimaryKey = "primary key"
+	DiffIndex      = "index"
+	DiffForeignKey = "foreign key"
+	DiffCheck      = "check"
+	DiffUnique     = "unique"
+)
+
+// SchemaChange is a difference between the two schemas
+type SchemaChange struct {
+	Kind   DiffKind
+	Object string
+	// Table is empty for the schema comment
+	Table string
+	// Name is the column,index or constraint name,empty for the table,the comment and the primary key
+	Name string
+	// Old and New are the object of the from and the to schema,nil when added or removed.
+	// they are *SchemaTable,*Column,*IndexDefine,*ForeignKey,*CheckConstraint,*UniqueConstraint,
+	// []string of the primary key or dbhelper.DBDesc of the comment
+	Old, New interface{}
+}
+
+func (c *SchemaChange) String() string {
+	switch {
+	case c.Table == "":
+		return fmt.Sprintf("%s the schema %s", c.Kind, c.Object)
+	case c.Object == DiffTable:
+		return fmt.Sprintf("%s the table %q", c.Kind, c.Table)
+	case c.Name == "":
+		return fmt.Sprintf("%s the %s of the table %q", c.Kind, c.Object, c.Table)
+	default:
+		return fmt.Sprintf("%s the %s %q of the table %q", c.Kind, c.Object, c.Name, c.Table)
+	}
+}
+
+// SchemaDiff is the changes that turn the from schema into the to schema
+type SchemaDiff struct {
+	Changes []*SchemaChange
+}
+
+func (d *SchemaDiff) add(kind DiffKind, object, table, name string, oldValue, newValue interface{}) {
+	d.Changes = append(d.Changes, &SchemaChange{Kind: kind, Object: object, Table: table, Name: name, Old: oldValue, New: newValue})
+}
+
+// Empty return true if the schemas are same
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Changes) == 0
+}
+
+// DiffSchema compare the from schema to the to schema,the schemas are the snapshots of the GetSchema,
+// read from the live databases or loaded from the saved JSON/YAML.
+// the renamed table or column is reported as removed and added
+func (p *PgMeta) DiffSchema(from, to *Schema) *SchemaDiff {
+	rev := &SchemaDiff{}
+	if !from.Desc.Equal(to.Desc) {
+		rev.add(DiffChanged, DiffComment, "", "", from.Desc, to.Desc)
+	}
+	for _, v := range from.Tables {
+		if to.Table(v.Name) == nil {
+			rev.add(DiffRemoved, DiffTable, v.Name, "", v, nil)
+		}
+	}
+	names := []string{}
+	for _, v := range to.Tables {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldTable, newTable := from.Table(name), to.Table(name)
+		if oldTable == nil {
+			rev.add(DiffAdded, DiffTable, name, "", nil, newTable)
+			continue
+		}
+		p.diffTable(rev, oldTable, newTable)
+	}
+	return rev
+}
+
+// diffTable append the changes of the table existing in both schemas
+func (p *PgMeta) diffTable(diff *SchemaDiff, oldTable, newTable *SchemaTable) {
+	name := newTable.Name
+	if !oldTable.Desc.Equal(newTable.Desc) {
+		diff.add(DiffChanged, DiffComment, name, "", oldTable.Desc, newTable.Desc)
+	}
+	oldColumns := map[string]*Column{}
+	for _, v := range oldTable.Columns {
+		oldColumns[v.Name] = v
+	}
+	newColumns := map[string]*Column{}
+	for _, v := range newTable.Columns {
+		newColumns[v.Name] = v
+	}
+	for _, v := range oldTable.Columns {
+		if newColumns[v.Name] == nil {
+			diff.add(DiffRemoved, DiffColumn, name, v.Name, v, nil)
+		}
+	}
+	for _, v := range newTable.Columns {
+		if old := oldColumns[v.Name]; old == nil {
+			diff.add(DiffAdded, DiffColumn, name, v.Name, nil, v)
+		} else if p.columnChanged(old, v) {
+			diff.add(DiffChanged, DiffColumn, name, v.Name, old, v)
+		}
+	}
+	switch {
+	case len(oldTable.PK) == 0 && len(newTable.PK) > 0:
+		diff.add(DiffAdded, DiffPrimaryKey, name, "", nil, newTable.PK)
+	case len(oldTable.PK) > 0 && len(newTable.PK) == 0:
+		diff.add(DiffRemoved, DiffPrimaryKey, name, "", oldTable.PK, nil)
+	case strings.Join(oldTable.PK, ",") != strings.Join(newTable.PK, ","):
+		diff.add(DiffChanged, DiffPrimaryKey, name, "", oldTable.PK, newTable.PK)
+	}
+
+	oldIndexes := map[string]*IndexDefine{}
+	for _, v := range oldTable.Indexes {
+		oldIndexes[v.Name] = v
+	}
+	newIndexes := map[string]*IndexDefine{}
+	for _, v := range newTable.Indexes {
+		newIndexes[v.Name] = v
+		if old := oldIndexes[v.Name]; old == nil {
+			diff.add(DiffAdded, DiffIndex, name, v.Name, nil, v)
+		} else if !indexEqual(old, v) || !old.Desc.Equal(v.Desc) {
+			diff.add(DiffChanged, DiffIndex, name, v.Name, old, v)
+		}
+	}
+	for _, v := range oldTable.Indexes {
+		if newIndexes[v.Name] == nil {
+			diff.add(DiffRemoved, DiffIndex, name, v.Name, v, nil)
+		}
+	}
+
+	oldFKs := map[string]*ForeignKey{}
+	for _, v := range oldTable.ForeignKeys {
+		oldFKs[v.Name] = v
+	}
+	newFKs := map[string]*ForeignKey{}
+	for _, v := range newTable.ForeignKeys {
+		newFKs[v.Name] = v
+		if old := oldFKs[v.Name]; old == nil {
+			diff.add(DiffAdded, DiffForeignKey, name, v.Name, nil, v)
+		} else if p.foreignKeyDefine(old) != p.foreignKeyDefine(v) {
+			diff.add(DiffChanged, DiffForeignKey, name, v.Name, old, v)
+		}
+	}
+	for _, v := range oldTable.ForeignKeys {
+		if newFKs[v.Name] == nil {
+			diff.add(DiffRemoved, DiffForeignKey, name, v.Name, v, nil)
+		}
+	}
+
+	oldChecks := map[string]*CheckConstraint{}
+	for _, v := range oldTable.Checks {
+		oldChecks[v.Name] = v
+	}
+	newChecks := map[string]*CheckConstraint{}
+	for _, v := range newTable.Checks {
+		newChecks[v.Name] = v
+		if old := oldChecks[v.Name]; old == nil {
+			diff.add(DiffAdded, DiffCheck, name, v.Name, nil, v)
+		} else if p.checkDefine(old) != p.checkDefine(v) {
+			diff.add(DiffChanged, DiffCheck, name, v.Name, old, v)
+		}
+	}
+	for _, v := range oldTable.Checks {
+		if newChecks[v.Name] == nil {
+			diff.add(DiffRemoved, DiffCheck, name, v.Name, v, nil)
+		}
+	}
+
+	oldUniques := map[string]*UniqueConstraint{}
+	for _, v := range oldTable.Uniques {
+		oldUniques[v.Name] = v
+	}
+	newUniques := map[string]*UniqueConstraint{}
+	for _, v := range newTable.Uniques {
+		newUniques[v.Name] = v
+		if old := oldUniques[v.Name]; old == nil {
+			diff.add(DiffAdded, DiffUnique, name, v.Name, nil, v)
+		} else if p.uniqueDefine(old) != p.uniqueDefine(v) {
+			diff.add(DiffChanged, DiffUnique, name, v.Name, old, v)
+		}
+	}
+	for _, v := range oldTable.Uniques {
+		if newUniques[v.Name] == nil {
+			diff.add(DiffRemoved, DiffUnique, name, v.Name, v, nil)
+		}
+	}
+}
+
+// columnChanged compare the columns like the AlterTableColumn,the owned sequence name is ignored
+func (p *PgMeta) columnChanged(oldColumn, newColumn *Column) bool {
+	return p.typeChanged(oldColumn, newColumn) ||
+		oldColumn.NotNull != newColumn.NotNull ||
+		oldColumn.Default != newColumn.Default ||
+		oldColumn.Identity != newColumn.Identity ||
+		!oldColumn.Desc.Equal(newColumn.Desc)
+}
+
+// indexEqual compare the index define,the comment is not compared
+func indexEqual(a, b *IndexDefine) bool {
+	method := func(m string) string {
+		if m == "" {
+			return "btree"
+		}
+		return m
+	}
+	return a.Unique == b.Unique &&
+		method(a.Method) == method(b.Method) &&
+		strings.Join(a.Keys, ",") == strings.Join(b.Keys, ",") &&
+		strings.Join(a.Include, ",") == strings.Join(b.Include, ",") &&
+		a.Where == b.Where
+}
+
+// ApplySchemaDiff reconcile the schema of the database to the to schema of the diff by the PgMeta mutators,
+// empty schema means the current schema.
+// set the Plan to capture the DDL instead of executing it.
+// the objects are changed in the dependency order:the foreign keys are dropped first and added last,
+// the indexes,constraints and primary key are dropped before the columns and added after them
+func (p *PgMeta) ApplySchemaDiff(schema string, diff *SchemaDiff) error {
+	qualify := func(name string) string {
+		if schema == "" {
+			return name
+		}
+		return schema + "." + name
+	}
+	//the RefTable of the snapshot is relative to the schema of the snapshot
+	qualifyFK := func(fk *ForeignKey) *ForeignKey {
+		rev := *fk
+		if refSchema, _ := splitTableName(rev.RefTable); refSchema == "" {
+			rev.RefTable = qualify(rev.RefTable)
+		}
+		return &rev
+	}
+	type phase func(c *SchemaChange) error
+	phases := []phase{
+		//drop the foreign keys,so the referenced tables and keys can be dropped
+		func(c *SchemaChange) error {
+			switch {
+			case c.Object == DiffForeignKey && c.Kind == DiffRemoved:
+				return p.DropForeignKey(qualify(c.Table), c.Name)
+			case c.Object == DiffTable && c.Kind == DiffRemoved:
+				for _, v := range c.Old.(*SchemaTable).ForeignKeys {
+					if err := p.DropForeignKey(qualify(c.Table), v.Name); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		func(c *SchemaChange) error {
+			if c.Object != DiffTable {
+				return nil
+			}
+			if c.Kind == DiffRemoved {
+				return p.DropTable(qualify(c.Table))
+			}
+			return p.createSchemaTable(qualify(c.Table), c.New.(*SchemaTable))
+		},
+		//drop the objects that depend on the columns
+		func(c *SchemaChange) error {
+			switch {
+			case c.Object == DiffPrimaryKey && c.Kind != DiffAdded:
+				return p.DropPrimaryKey(qualify(c.Table))
+			case c.Kind != DiffRemoved:
+				return nil
+			case c.Object == DiffIndex:
+				return p.DropIndex(qualify(c.Table), c.Name)
+			case c.Object == DiffCheck, c.Object == DiffUnique:
+				return p.DropConstraint(qualify(c.Table), c.Name)
+			}
+			return nil
+		},
+		func(c *SchemaChange) error {
+			if c.Object != DiffColumn {
+				return nil
+			}
+			switch c.Kind {
+			case DiffRemoved:
+				return p.DropColumn(qualify(c.Table), c.Name)
+			case DiffAdded:
+				return p.AddTableColumn(qualify(c.Table), c.New.(*Column))
+			default:
+				return p.AlterTableColumn(qualify(c.Table), c.Old.(*Column), c.New.(*Column))
+			}
+		},
+		func(c *SchemaChange) error {
+			tablename := qualify(c.Table)
+			switch {
+			case c.Object == DiffPrimaryKey && c.Kind != DiffRemoved:
+				return p.AddPrimaryKey(tablename, c.New.([]string))
+			case c.Object == DiffIndex && c.Kind == DiffAdded:
+				return p.CreateIndexDefine(tablename, c.New.(*IndexDefine))
+			case c.Object == DiffIndex && c.Kind == DiffChanged:
+				oldIndex, newIndex := c.Old.(*IndexDefine), c.New.(*IndexDefine)
+				if indexEqual(oldIndex, newIndex) {
+					return p.commentIndex(tablename, newIndex.Name, newIndex.Desc)
+				}
+				return p.AlterIndexDefine(tablename, oldIndex, newIndex)
+			case c.Object == DiffCheck && c.Kind == DiffAdded:
+				return p.AddCheckConstraint(tablename, c.New.(*CheckConstraint))
+			case c.Object == DiffCheck && c.Kind == DiffChanged:
+				return p.AlterCheckConstraint(tablename, c.Old.(*CheckConstraint), c.New.(*CheckConstraint))
+			case c.Object == DiffUnique && c.Kind == DiffAdded:
+				return p.AddUniqueConstraint(tablename, c.New.(*UniqueConstraint))
+			case c.Object == DiffUnique && c.Kind == DiffChanged:
+				return p.AlterUniqueConstraint(tablename, c.Old.(*UniqueConstraint), c.New.(*UniqueConstraint))
+			case c.Object == DiffComment && c.Table != "":
+				return p.AlterTableDesc(tablename, c.New.(dbhelper.DBDesc))
+			case c.Object == DiffComment:
+				return p.alterSchemaDesc(schema, c.New.(dbhelper.DBDesc))
+			}
+			return nil
+		},
+		//add the foreign keys after all the tables and keys exist
+		func(c *SchemaChange) error {
+			switch {
+			case c.Object == DiffTable && c.Kind == DiffAdded:
+				for _, v := range c.New.(*SchemaTable).ForeignKeys {
+					if err := p.AddForeignKey(qualify(c.Table), qualifyFK(v)); err != nil {
+						return err
+					}
+				}
+			case c.Object == DiffForeignKey && c.Kind == DiffAdded:
+				return p.AddForeignKey(qualify(c.Table), qualifyFK(c.New.(*ForeignKey)))
+			case c.Object == DiffForeignKey && c.Kind == DiffChanged:
+				return p.AlterForeignKey(qualify(c.Table), qualifyFK(c.Old.(*ForeignKey)), qualifyFK(c.New.(*ForeignKey)))
+			}
+			return nil
+		},
+	}
+	for _, run := range phases {
+		for _, c := range diff.Changes {
+			if err := run(c); err != nil {
+				return fmt.Errorf("apply the %s fail:%s", c, err)
+			}
+		}
+	}
+	return nil
+}
+
+// createSchemaTable create the table with its indexes and constraints except the foreign keys
+func (p *PgMeta) createSchemaTable(tablename string, table *SchemaTable) error {
+	define := table.Table
+	define.Name = tablename
+	if err := p.CreateTableDefine(&define); err != nil {
+		return err
+	}
+	for _, v := range table.Indexes {
+		if err := p.CreateIndexDefine(tablename, v); err != nil {
+			return err
+		}
+	}
+	for _, v := range table.Checks {
+		if err := p.AddCheckConstraint(tablename, v); err != nil {
+			return err
+		}
+	}
+	for _, v := range table.Uniques {
+		if err := p.AddUniqueConstraint(tablename, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropTable drop the table
+func (p *PgMeta) DropTable(tablename string) error {
+	return p.exec(fmt.Sprintf("drop the table %q", tablename),
+		fmt.Sprintf(SQL_DropTable, p.QuoteTableName(tablename)), true)
+}
+
+// DropColumn drop the column of the table
+func (p *PgMeta) DropColumn(tablename, columnname string) error {
+	return p.exec(fmt.Sprintf("drop the column %q of the table %q", columnname, tablename),
+		fmt.Sprintf(SQL_DropColumn, p.QuoteTableName(tablename), p.QuoteIdent(columnname)), true)
+}
+
+// alterSchemaDesc comment the schema,empty schema means the current schema
+func (p *PgMeta) alterSchemaDesc(schema string, desc dbhelper.DBDesc) error {
+	if schema == "" {
+		table, err := p.DBHelper.GetData(SQL_GetCurrentSchemaAndDesc)
+		if err != nil {
+			return err
+		}
+		schema = valueString(table.Row(0)["nspname"])
+	}
+	name := p.QuoteIdent(schema)
+	if desc.IsEmpty() {
+		return p.exec("comment the schema", fmt.Sprintf("COMMENT ON SCHEMA %s IS NULL", name), false)
+	}
+	return p.exec("comment the schema", fmt.Sprintf(SQL_AlterSchemaDesc, name, p.StringExpress(desc.String())), false)
+}
@@ -1,8 +1,13 @@
 package pghelper
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/linlexing/datatable.go"
 	"github.com/linlexing/dbhelper"
+	"io"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -132,3 +137,852 @@ insert into b(
 		t.Error(err)
 	}
 }
+func TestSplitTableName(t *testing.T) {
+	if schema, table := splitTableName("billing.invoice"); schema != "billing" || table != "invoice" {
+		t.Errorf("got %q,%q", schema, table)
+	}
+	if schema, table := splitTableName("invoice"); schema != "" || table != "invoice" {
+		t.Errorf("got %q,%q", schema, table)
+	}
+}
+func TestQuoteIdent(t *testing.T) {
+	meta := NewPgMeta()
+	if name := meta.QuoteIdent(`my "user"`); name != `"my ""user"""` {
+		t.Errorf("got %s", name)
+	}
+	if name := meta.QuoteTableName("Billing.Order"); name != `"Billing"."Order"` {
+		t.Errorf("got %s", name)
+	}
+	if name := meta.quoteIndexName("billing.invoice", "invoice_idx"); name != `"billing"."invoice_idx"` {
+		t.Errorf("got %s", name)
+	}
+}
+func TestTypeRegistry(t *testing.T) {
+	types := NewTypeRegistry()
+	for dbType, want := range map[string]datatable.ColumnType{
+		"integer":                        datatable.Int64,
+		"numeric(12,2)":                  datatable.Float64,
+		"uuid":                           datatable.String,
+		"jsonb":                          datatable.String,
+		"character(10)":                  datatable.String,
+		"timestamp(3) without time zone": datatable.Time,
+		"interval":                       datatable.String,
+		"integer[]":                      datatable.String,
+	} {
+		if got, _, _, err := types.Parse(dbType); err != nil || got != want {
+			t.Errorf("%s:got %s,%v", dbType, got, err)
+		}
+	}
+	if _, maxSize, _, _ := types.Parse("character varying(50)"); maxSize != 50 {
+		t.Errorf("got max size %d", maxSize)
+	}
+	if _, _, modifiers, _ := types.Parse("numeric(12,2)"); len(modifiers) != 2 || modifiers[0] != 12 || modifiers[1] != 2 {
+		t.Errorf("got modifiers %v", modifiers)
+	}
+	if define := types.Define(datatable.String, 20); define != "character varying(20)" {
+		t.Errorf("got %s", define)
+	}
+	if define := types.Define(datatable.Float64, 0, 12, 2); define != "numeric(12,2)" {
+		t.Errorf("got %s", define)
+	}
+	if define := types.Define(datatable.Time, 0, 3); define != "timestamp(3) without time zone" {
+		t.Errorf("got %s", define)
+	}
+	meta := &PgMeta{RootMeta: &dbhelper.RootMeta{}}
+	if define := meta.columnDefine(NewColumn(&dbhelper.TableColumn{Type: datatable.Int64})); define != "bigint" {
+		t.Errorf("got %s", define)
+	}
+}
+func TestIdentity(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.DropTable("test_identity"); err != nil {
+		t.Error(err)
+	}
+	table := &Table{
+		Name: "test_identity",
+		Columns: []*Column{
+			{TableColumn: &dbhelper.TableColumn{Name: "id", Type: datatable.Int64}, Identity: IdentityAlways},
+			{TableColumn: &dbhelper.TableColumn{Name: "name", Type: datatable.String, MaxSize: 50}},
+		},
+		PK: []string{"id"},
+	}
+	if err := meta.CreateTableDefine(table); err != nil {
+		t.Error(err)
+	}
+	row, err := meta.InsertReturning("test_identity", map[string]interface{}{"name": "a"}, "id")
+	if err != nil {
+		t.Error(err)
+	} else if row["id"].(int64) != 1 {
+		t.Errorf("got id %v", row["id"])
+	}
+	columns, err := meta.GetTableColumns("test_identity")
+	if err != nil {
+		t.Error(err)
+	} else if columns[0].Identity != IdentityAlways || columns[0].Sequence == "" {
+		t.Errorf("got identity %q,sequence %q", columns[0].Identity, columns[0].Sequence)
+	}
+}
+func TestForeignKeyDefine(t *testing.T) {
+	meta := NewPgMeta()
+	fk := &ForeignKey{
+		Name:       "fk_invoice_customer",
+		Columns:    []string{"customer_id"},
+		RefTable:   "crm.customer",
+		RefColumns: []string{"id"},
+		OnDelete:   FKCascade,
+		Deferrable: true,
+		NotValid:   true,
+	}
+	want := `CONSTRAINT "fk_invoice_customer" FOREIGN KEY("customer_id") REFERENCES "crm"."customer"("id") ON DELETE CASCADE DEFERRABLE INITIALLY IMMEDIATE NOT VALID`
+	if define := meta.foreignKeyDefine(fk); define != want {
+		t.Errorf("got %s", define)
+	}
+}
+func TestConstraintDefine(t *testing.T) {
+	meta := NewPgMeta()
+	if define := meta.checkDefine(&CheckConstraint{Name: "ck_price", Expression: "price > 0", NotValid: true}); define != `CONSTRAINT "ck_price" CHECK (price > 0) NOT VALID` {
+		t.Errorf("got %s", define)
+	}
+	if define := meta.uniqueDefine(&UniqueConstraint{Name: "uq_code", Columns: []string{"code", "Order"}}); define != `CONSTRAINT "uq_code" UNIQUE("code","Order") NOT DEFERRABLE` {
+		t.Errorf("got %s", define)
+	}
+	meta.Plan = &Plan{}
+	if err := meta.AlterUniqueConstraint("a", &UniqueConstraint{Name: "uq_code", Columns: []string{"code"}},
+		&UniqueConstraint{Name: "uq_code", Columns: []string{"code"}, Deferrable: true}); err != nil {
+		t.Error(err)
+	}
+	if len(meta.Plan.Steps) != 2 || !strings.HasPrefix(meta.Plan.Steps[1].SQL, `ALTER TABLE "a" ADD CONSTRAINT "uq_code" UNIQUE("code") DEFERRABLE`) {
+		t.Errorf("got %s", meta.Plan)
+	}
+}
+func TestCheckRule(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.GoExec(`
+drop table IF EXISTS lx_check
+go
+create table lx_check(
+	tablename varchar(200) not null,
+	id varchar(200) not null,
+	displaylabel varchar(200),
+	level bigint,
+	fields text,
+	script text,
+	grade bigint,
+	primary key(tablename,id)
+)`); err != nil {
+		t.Error(err)
+	}
+	rule := &CheckRule{ID: "c1", DisplayLabel: "price", Level: 1, Fields: []string{"price", "qty"}, Script: "price > 0"}
+	if err := meta.SaveCheckRule("a", rule); err != nil {
+		t.Error(err)
+	}
+	rule.Grade = 2
+	if err := meta.SaveCheckRule("a", rule); err != nil {
+		t.Error(err)
+	}
+	rules, err := meta.GetCheckRules("a")
+	if err != nil {
+		t.Error(err)
+	} else if len(rules) != 1 || !reflect.DeepEqual(rules[0], rule) {
+		t.Errorf("got %v", rules)
+	}
+	if err := meta.DeleteCheckRule("a", "c1"); err != nil {
+		t.Error(err)
+	}
+	if rules, err = meta.GetCheckRules("a"); err != nil || len(rules) != 0 {
+		t.Errorf("got %v,%v", rules, err)
+	}
+}
+func TestParseIndexDef(t *testing.T) {
+	keys, include, err := parseIndexDef(`CREATE UNIQUE INDEX a_idx ON public.a USING btree (lower((email)::text), "Name" DESC NULLS LAST, substr(code, 1, 2)) INCLUDE (id, "Order") WHERE (state = 'a,b')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, "|") != `lower((email)::text)|"Name" DESC NULLS LAST|substr(code, 1, 2)` {
+		t.Errorf("got keys %v", keys)
+	}
+	if strings.Join(include, "|") != `id|"Order"` {
+		t.Errorf("got include %v", include)
+	}
+	if columns := indexColumns([]string{"id", `"Order"`, "lower(name)"}); strings.Join(columns, "|") != "id|Order|lower(name)" {
+		t.Errorf("got columns %v", columns)
+	}
+	if keys := NewPgMeta().indexKeys(indexColumns(keys)); strings.Join(keys, "|") != `lower((email)::text)|"Name" DESC NULLS LAST|substr(code, 1, 2)` {
+		t.Errorf("got keys %v", keys)
+	}
+	if keys := NewPgMeta().indexKeys([]string{"id", "Order"}); strings.Join(keys, "|") != `"id"|"Order"` {
+		t.Errorf("got keys %v", keys)
+	}
+}
+func TestAlterIndex(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.GoExec(`
+drop table IF EXISTS a
+go
+create table a(
+	id bigint not null,
+	"Name" varchar(200),
+	email varchar(200),
+	primary key(id)
+)
+go
+create index a_email on a(lower(email),"Name" DESC)`); err != nil {
+		t.Error(err)
+	}
+	indexes, err := meta.GetIndexes("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 {
+		t.Fatalf("got %d indexes", len(indexes))
+	}
+	//the expression keys are passed back with a new column
+	index := &dbhelper.Index{Columns: append(indexes[0].Columns, "id"), Unique: true, Desc: indexes[0].Desc}
+	if err := meta.AlterIndex("a", "a_email", &indexes[0].Index, index); err != nil {
+		t.Error(err)
+	}
+	defines, err := meta.GetIndexDefines("a")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(defines) != 1 || !defines[0].Unique || strings.Join(defines[0].Keys, "|") != `lower((email)::text)|"Name" DESC|id` {
+		t.Errorf("got %v", defines)
+	}
+}
+func TestConcurrentIndexDefine(t *testing.T) {
+	meta := NewPgMeta()
+	meta.ConcurrentIndex = true
+	index := &IndexDefine{Name: "a_email", Unique: true, Method: "btree", Keys: []string{"lower(email)"}, Where: "deleted = false"}
+	if define := meta.indexDefine("a", index); define != `CREATE UNIQUE INDEX CONCURRENTLY "a_email" ON "a"(lower(email)) WHERE deleted = false` {
+		t.Errorf("got %s", define)
+	}
+	if name := shadowName(strings.Repeat("x", 63), "_pghelper_tmp"); len(name) != 63 {
+		t.Errorf("got %s", name)
+	}
+	meta.Plan = &Plan{}
+	if err := meta.AlterIndexDefine("a", index, index); err != nil {
+		t.Error(err)
+	}
+	if len(meta.Plan.Steps) < 2 || meta.Plan.Steps[0].SQL != `DROP INDEX CONCURRENTLY IF EXISTS "a_email_pghelper_tmp"` {
+		t.Fatalf("got %s", meta.Plan)
+	}
+	//the failed build drop the invalid index when the plan is applied
+	if cleanup := meta.Plan.Steps[1].Cleanup; len(cleanup) != 1 || cleanup[0].InvalidIndex == nil ||
+		cleanup[0].InvalidIndex.Name != "a_email_pghelper_tmp" {
+		t.Errorf("got %v", cleanup)
+	}
+}
+func TestPlan(t *testing.T) {
+	meta := NewPgMeta()
+	meta.Plan = &Plan{}
+	if err := meta.AddPrimaryKey("billing.invoice", []string{"id"}); err != nil {
+		t.Error(err)
+	}
+	if err := meta.DropIndex("billing.invoice", "invoice_idx"); err != nil {
+		t.Error(err)
+	}
+	if len(meta.Plan.Steps) != 2 || meta.Plan.Steps[0].Destructive || !meta.Plan.Destructive() {
+		t.Errorf("got %v", meta.Plan.Steps)
+	}
+	if meta.Plan.Steps[0].Batch != 1 || meta.Plan.Steps[1].Batch != 2 {
+		t.Errorf("got batch %d,%d", meta.Plan.Steps[0].Batch, meta.Plan.Steps[1].Batch)
+	}
+	want := `-- add the primary key of the table "billing.invoice"
+ALTER TABLE "billing"."invoice" ADD PRIMARY KEY("id");
+-- drop the index "invoice_idx" of the table "billing.invoice" (destructive)
+DROP INDEX "billing"."invoice_idx";
+`
+	if script := meta.Plan.String(); script != want {
+		t.Errorf("got %s", script)
+	}
+	serial := &Column{TableColumn: &dbhelper.TableColumn{Name: "id", Type: datatable.Int64}, Identity: IdentitySerial}
+	identity := &Column{TableColumn: &dbhelper.TableColumn{Name: "id", Type: datatable.Int64}, Identity: IdentityAlways}
+	if err := meta.AlterTableColumn("billing.invoice", serial, identity); err == nil {
+		t.Error("the serial changed to the identity")
+	}
+	meta.Plan = &Plan{}
+	column := &Column{TableColumn: &dbhelper.TableColumn{Name: "state", Type: datatable.String, NotNull: true}, NullFill: "'new'"}
+	if err := meta.AddTableColumn("a", column); err != nil {
+		t.Error(err)
+	}
+	want = `-- add the column "state"
+ALTER TABLE "a" ADD COLUMN "state" text NOT NULL DEFAULT 'new';
+-- drop the column "state" fill default
+ALTER TABLE "a" ALTER COLUMN "state" DROP DEFAULT;
+`
+	if script := meta.Plan.String(); script != want {
+		t.Errorf("got %s", script)
+	}
+	meta.Plan = &Plan{}
+	oldColumn := &Column{TableColumn: &dbhelper.TableColumn{Name: "id", Type: datatable.Int64}, Default: "0"}
+	newColumn := &Column{TableColumn: &dbhelper.TableColumn{Name: "id", Type: datatable.Int64}, Identity: IdentityByDefault, NullFill: "0"}
+	if err := meta.AlterTableColumn("a", oldColumn, newColumn); err != nil {
+		t.Error(err)
+	}
+	sqls := []string{}
+	for _, v := range meta.Plan.Steps {
+		sqls = append(sqls, v.SQL)
+	}
+	want = `ALTER TABLE "a" ALTER COLUMN "id" DROP DEFAULT|UPDATE "a" SET "id" = 0 WHERE "id" IS NULL|` +
+		`ALTER TABLE "a" ALTER COLUMN "id" SET NOT NULL|ALTER TABLE "a" ALTER COLUMN "id" ADD GENERATED BY DEFAULT AS IDENTITY|` +
+		`SELECT setval(pg_get_serial_sequence(E'"a"',E'id'),coalesce(max("id"),0)+1,false) FROM "a"`
+	if got := strings.Join(sqls, "|"); got != want {
+		t.Errorf("got %s", got)
+	}
+	meta.serverVersion = 150002
+	if version, err := meta.ServerVersion(); err != nil || version != 150002 {
+		t.Errorf("got %d,%v", version, err)
+	}
+}
+func TestUsingCast(t *testing.T) {
+	meta := NewPgMeta()
+	oldColumn := NewColumn(&dbhelper.TableColumn{Name: "bool1", Type: datatable.String})
+	newColumn := NewColumn(&dbhelper.TableColumn{Name: "bool1", Type: datatable.Bool})
+	if cast := meta.usingCast(`"bool1"`, oldColumn, newColumn); cast != `nullif(lower(trim("bool1")),'')::boolean` {
+		t.Errorf("got %s", cast)
+	}
+	if cast := meta.usingCast(`"bool1"`, newColumn, oldColumn); cast != `"bool1"::text` {
+		t.Errorf("got %s", cast)
+	}
+	oldColumn = NewColumn(&dbhelper.TableColumn{Name: "str1", Type: datatable.String, MaxSize: 300})
+	newColumn = NewColumn(&dbhelper.TableColumn{Name: "str1", Type: datatable.String, MaxSize: 200})
+	if cond := meta.lossCondition(`"str1"`, oldColumn, newColumn); cond != `length("str1"::text) > 200` {
+		t.Errorf("got %s", cond)
+	}
+	if cond := meta.lossCondition(`"str1"`, newColumn, oldColumn); cond != "" {
+		t.Errorf("got %s", cond)
+	}
+	newColumn = &Column{TableColumn: &dbhelper.TableColumn{Name: "str1", Type: datatable.Time, NotNull: true}, NullFill: "now()"}
+	if cond := meta.lossCondition(`"str1"`, oldColumn, newColumn); !strings.HasPrefix(cond, `trim("str1") <> '' AND trim("str1") !~*`) {
+		t.Errorf("got %s", cond)
+	}
+	if cast := meta.usingCast(`"str1"`, oldColumn, newColumn); cast != `coalesce(nullif(trim("str1"),'')::timestamp without time zone,now())` {
+		t.Errorf("got %s", cast)
+	}
+	oldColumn = NewColumn(&dbhelper.TableColumn{Name: "float1", Type: datatable.Float64})
+	newColumn = NewColumn(&dbhelper.TableColumn{Name: "float1", Type: datatable.Bool})
+	if cast := meta.usingCast(`"float1"`, oldColumn, newColumn); cast != `"float1" <> 0` {
+		t.Errorf("got %s", cast)
+	}
+	if cond := meta.lossCondition(`"float1"`, oldColumn, newColumn); cond != `"float1" NOT IN (0,1)` {
+		t.Errorf("got %s", cond)
+	}
+	for _, v := range [][2]datatable.ColumnType{
+		{datatable.Time, datatable.Int64},
+		{datatable.Time, datatable.Float64},
+		{datatable.Int64, datatable.Time},
+		{datatable.Int64, datatable.Bytea},
+		{datatable.Bytea, datatable.Bool},
+	} {
+		oldColumn = NewColumn(&dbhelper.TableColumn{Name: "col1", Type: v[0]})
+		newColumn = NewColumn(&dbhelper.TableColumn{Name: "col1", Type: v[1]})
+		if err := meta.checkTypeChange("a", oldColumn, newColumn); err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("%v to %v got %v", v[0], v[1], err)
+		}
+	}
+	meta.Plan = &Plan{}
+	oldColumn = &Column{TableColumn: &dbhelper.TableColumn{Name: "int1", Type: datatable.Int64}, Default: "0"}
+	newColumn = &Column{TableColumn: &dbhelper.TableColumn{Name: "int1", Type: datatable.String}, Default: "''"}
+	if err := meta.AlterTableColumn("a", oldColumn, newColumn); err != nil {
+		t.Error(err)
+	}
+	want := `ALTER TABLE "a" ALTER COLUMN "int1" DROP DEFAULT|ALTER TABLE "a" ALTER COLUMN "int1" TYPE text USING "int1"::text|ALTER TABLE "a" ALTER COLUMN "int1" SET DEFAULT ''`
+	sqls := []string{}
+	for _, v := range meta.Plan.Steps {
+		sqls = append(sqls, v.SQL)
+	}
+	if got := strings.Join(sqls, "|"); got != want {
+		t.Errorf("got %s", got)
+	}
+}
+func TestOnlineColumn(t *testing.T) {
+	meta := NewPgMeta()
+	oldColumn := NewColumn(&dbhelper.TableColumn{Name: "bool1", Type: datatable.Bool, NotNull: true})
+	newColumn := NewColumn(&dbhelper.TableColumn{Name: "bool1", Type: datatable.String, NotNull: true})
+	column := onlineColumn(oldColumn, newColumn)
+	if meta.typeChanged(column, newColumn) || column.NotNull {
+		t.Errorf("got %s,%v", meta.columnDefine(column), column.NotNull)
+	}
+}
+func TestMergeSQL(t *testing.T) {
+	meta := NewPgMeta()
+	opts := &MergeOptions{
+		Dest:       "a",
+		Source:     "b",
+		Columns:    []string{"id", "name"},
+		PKColumns:  []string{"id"},
+		AutoUpdate: true,
+		AutoRemove: true,
+		Where:      "id=2",
+	}
+	stmts, err := meta.mergeSQL(opts, 140000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stmts.sql, "ON CONFLICT") || !strings.Contains(stmts.sql, "updated as (") {
+		t.Errorf("got %s", stmts.sql)
+	}
+	opts.uniqueKey = true
+	if stmts, err = meta.mergeSQL(opts, 140000); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmts.sql, `ON CONFLICT("id") DO UPDATE SET`) ||
+		!strings.Contains(stmts.sql, `"name" = EXCLUDED."name"`) ||
+		!strings.Contains(stmts.sql, "(SELECT count(*) FROM updated) AS updated") {
+		t.Errorf("got %s", stmts.sql)
+	}
+	if stmts, err = meta.mergeSQL(opts, 150000); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(stmts.deleteSQL), `DELETE FROM "a" dest`) || stmts.matchedSQL == "" ||
+		!strings.HasPrefix(strings.TrimSpace(stmts.sql), `MERGE INTO "a" dest`) {
+		t.Errorf("got %s", stmts.sql)
+	}
+	if stmts, err = meta.mergeSQL(opts, 170000); err != nil {
+		t.Fatal(err)
+	}
+	if stmts.matchedSQL != "" || !strings.Contains(stmts.sql, "WHEN NOT MATCHED BY SOURCE AND (id=2) THEN") ||
+		!strings.Contains(stmts.sql, "RETURNING merge_action()") {
+		t.Errorf("got %s", stmts.sql)
+	}
+	opts.Strategy = MergeCTE
+	opts.ReturnKeys = true
+	if stmts, err = meta.mergeSQL(opts, 170000); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmts.sql, "updated as (") || !strings.Contains(stmts.sql, `SELECT 'INSERT' AS pghelper_action,"id" FROM inserted`) {
+		t.Errorf("got %s", stmts.sql)
+	}
+	opts.OnlyChanged = true
+	if stmts, err = meta.mergeSQL(opts, 170000); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmts.sql, `AND ROW((dest."name")::text) IS DISTINCT FROM ROW((src."name")::text)`) || !strings.Contains(stmts.sql, "WHERE NOT EXISTS(") {
+		t.Errorf("got %s", stmts.sql)
+	}
+	opts.Strategy = MergeNative
+	if _, err = meta.mergeSQL(opts, 160000); err == nil {
+		t.Error("the MERGE of PostgreSQL 16 return the keys")
+	}
+	opts.ReturnKeys = false
+	opts.Where = "dest.name <> $1"
+	opts.WhereArgs = []interface{}{"a"}
+	opts.WhereAll = true
+	if stmts, err = meta.mergeSQL(opts, 160000); err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts.args) != 1 || len(stmts.deleteArgs) != 1 || len(stmts.matchedArgs) != 1 ||
+		!strings.Contains(stmts.sql, `WHEN NOT MATCHED AND EXISTS(SELECT 1 FROM (SELECT src."id" AS "id",src."name" AS "name") dest WHERE dest.name <> $1)`) {
+		t.Errorf("got %s", stmts.sql)
+	}
+	opts.Where = ""
+	opts.WhereArgs = nil
+	opts.WhereAll = false
+	opts.ReturnKeys = true
+	opts.SourceColumns = map[string]string{"name": "src.full_name"}
+	opts.SoftDelete = map[string]string{"deleted": "true"}
+	if stmts, err = meta.mergeSQL(opts, 170000); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmts.sql, `"name" = src.full_name`) || !strings.Contains(stmts.sql, `"deleted" = true`) ||
+		strings.Contains(stmts.sql, "NOT MATCHED BY SOURCE") {
+		t.Errorf("got %s", stmts.sql)
+	}
+	if !strings.Contains(stmts.sql, `ROW((dest."deleted")::text) IS DISTINCT FROM ROW((true)::text) AND`) {
+		t.Errorf("got %s", stmts.sql)
+	}
+	opts.SoftDelete["deleted_at"] = "now()"
+	opts.SoftDeleted = "dest.deleted"
+	if stmts, err = meta.mergeSQL(opts, 170000); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmts.sql, `(dest.deleted) IS NOT TRUE AND`) || !strings.Contains(stmts.sql, `"deleted_at" = now()`) {
+		t.Errorf("got %s", stmts.sql)
+	}
+}
+func TestMergeTable(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.GoExec(`
+drop table IF EXISTS a
+go
+create table a(
+	id bigint not null,
+	name varchar(200),
+	primary key(id)
+)
+go
+insert into a(id,name)values(1,'name1')`); err != nil {
+		t.Error(err)
+	}
+	rows := dbhelper.NewDataTable("a")
+	rows.AddColumn(dbhelper.NewDataColumn("id", datatable.Int64, 0, true))
+	rows.AddColumn(dbhelper.NewDataColumn("name", datatable.String, 200, false))
+	rows.SetPK("id")
+	rows.AddValues(int64(1), "name11")
+	rows.AddValues(int64(2), "name2")
+	result, err := meta.MergeTable("a", rows, &MergeOptions{AutoUpdate: true})
+	if err != nil {
+		t.Error(err)
+	} else if result.Inserted != 1 || result.Updated != 1 {
+		t.Errorf("got %#v", result)
+	}
+}
+func TestMergeBatchRange(t *testing.T) {
+	meta := NewPgMeta()
+	if got := meta.rowExpress([]interface{}{int64(5), "a'b", nil}); got != `ROW(5,E'a\'b',NULL)` {
+		t.Errorf("got %s", got)
+	}
+	opts := &MergeOptions{
+		Dest:       "a",
+		Source:     "b",
+		Columns:    []string{"id", "name"},
+		PKColumns:  []string{"id"},
+		AutoUpdate: true,
+		AutoRemove: true,
+		srcRange:   `ROW(src."id") > ROW(5)`,
+		destRange:  `ROW(dest."id") > ROW(5)`,
+	}
+	stmts, err := meta.mergeSQL(opts, 170000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmts.sql, `USING (SELECT * FROM "b" src WHERE ROW(src."id") > ROW(5)) src`) ||
+		!strings.Contains(stmts.sql, `WHEN NOT MATCHED BY SOURCE AND ROW(dest."id") > ROW(5) THEN`) {
+		t.Errorf("got %s", stmts.sql)
+	}
+}
+func TestMergeBatched(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.GoExec(`
+drop table IF EXISTS a
+go
+drop table IF EXISTS b
+go
+create table a(
+	id bigint not null,
+	name varchar(200),
+	primary key(id)
+)
+go
+create table b(
+	id bigint not null,
+	name varchar(200),
+	primary key(id)
+)
+go
+insert into a(id,name)values(1,'name1'),(4,'name4')
+go
+insert into b(id,name)values(1,'name11'),(2,'name2'),(3,'name3')`); err != nil {
+		t.Error(err)
+	}
+	checkpoints := 0
+	done := false
+	result, err := meta.MergeBatched(&MergeOptions{
+		Dest:       "a",
+		Source:     "b",
+		Columns:    []string{"id", "name"},
+		PKColumns:  []string{"id"},
+		AutoUpdate: true,
+		AutoRemove: true,
+	}, &MergeBatch{
+		Size: 2,
+		Progress: func(result *MergeResult, checkpoint []interface{}) error {
+			checkpoints++
+			done = checkpoint == nil
+			return nil
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	} else if result.Inserted != 2 || result.Updated != 1 || result.Deleted != 1 || checkpoints != 2 || !done {
+		t.Errorf("got %#v,%d checkpoints", result, checkpoints)
+	}
+}
+func TestCopyValue(t *testing.T) {
+	for _, v := range []struct {
+		dataType datatable.ColumnType
+		value    interface{}
+		want     interface{}
+	}{
+		{datatable.String, []byte("abc"), "abc"},
+		{datatable.String, int64(12), "12"},
+		{datatable.Bool, int64(1), true},
+		{datatable.Int64, float64(3), int64(3)},
+		{datatable.Float64, int64(3), float64(3)},
+		{datatable.Int64, "12", "12"},
+		{datatable.Bytea, "abc", []byte("abc")},
+		{datatable.Time, nil, nil},
+	} {
+		got, err := copyValue(v.dataType, v.value)
+		if err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("%s %#v got %#v", v.dataType, v.value, got)
+		}
+	}
+	if _, err := copyValue(datatable.Int64, 1.5); err == nil {
+		t.Error("convert 1.5 to int64")
+	}
+}
+func TestCopyIn(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.GoExec(`
+drop table IF EXISTS a
+go
+create table a(
+	id bigint not null,
+	name varchar(200),
+	primary key(id)
+)`); err != nil {
+		t.Error(err)
+	}
+	rows := dbhelper.NewDataTable("a")
+	rows.AddColumn(dbhelper.NewDataColumn("id", datatable.Int64, 0, true))
+	rows.AddColumn(dbhelper.NewDataColumn("name", datatable.String, 200, false))
+	rows.AddValues(int64(1), "name1")
+	rows.AddValues(int64(2), nil)
+	if err := meta.CopyIn("a", rows); err != nil {
+		t.Error(err)
+	}
+	i := int64(2)
+	count, err := meta.CopyInSource("a", rows.Columns, func() ([]interface{}, error) {
+		if i == 5 {
+			return nil, io.EOF
+		}
+		i++
+		return []interface{}{i, []byte("name")}, nil
+	})
+	if err != nil {
+		t.Error(err)
+	} else if count != 3 {
+		t.Errorf("got %d rows", count)
+	}
+}
+func TestCopyField(t *testing.T) {
+	text := &CopyFormat{Type: CopyText, Delimiter: '\t', Null: `\N`}
+	if got := copyField("a\tb\\c\n", text); got != `a\tb\\c\n` {
+		t.Errorf("got %s", got)
+	}
+	csv := &CopyFormat{Type: CopyCSV, Delimiter: ','}
+	for value, want := range map[string]string{
+		"abc":   "abc",
+		"":      `""`,
+		"a,b":   `"a,b"`,
+		`a"b`:   `"a""b"`,
+		"a\nb":  "\"a\nb\"",
+		"a b c": "a b c",
+	} {
+		if got := copyField(value, csv); got != want {
+			t.Errorf("%q got %s", value, got)
+		}
+	}
+	if !regCopyQuery.MatchString(" SELECT * from a") || regCopyQuery.MatchString("public.selection") {
+		t.Error("the query is not told from the table")
+	}
+	for _, v := range []string{"-- the rows\nSELECT 1", "/* the /* nested */ rows */ WITH a AS (SELECT 1) TABLE a"} {
+		if !regCopyQuery.MatchString(stripComments(v)) {
+			t.Errorf("%q is not a query", v)
+		}
+	}
+	if got := stripComments("/* the table */ a"); got != "a" {
+		t.Errorf("got %s", got)
+	}
+}
+func TestCopyOut(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.GoExec(`
+drop table IF EXISTS a
+go
+create table a(
+	id bigint not null,
+	name varchar(200),
+	primary key(id)
+)
+go
+insert into a(id,name)values(1,'name,1'),(2,null)`); err != nil {
+		t.Error(err)
+	}
+	var b bytes.Buffer
+	count, err := meta.CopyOut("SELECT * FROM a ORDER BY id", &b, &CopyFormat{Type: CopyCSV, Header: true})
+	if err != nil {
+		t.Error(err)
+	} else if count != 2 || b.String() != "id,name\n1,\"name,1\"\n2,\n" {
+		t.Errorf("got %d rows:%s", count, b.String())
+	}
+	b.Reset()
+	//the duplicate and unnamed columns,the leading and trailing comments
+	count, err = meta.CopyOut("-- the ids\nSELECT id,id,id+1 FROM a ORDER BY id -- the order", &b, &CopyFormat{Type: CopyCSV, Header: true})
+	if err != nil {
+		t.Error(err)
+	} else if count != 2 || b.String() != "id,id,?column?\n1,1,2\n2,2,3\n" {
+		t.Errorf("got %d rows:%s", count, b.String())
+	}
+	b.Reset()
+	if _, err := meta.CopyOut("a", &b, &CopyFormat{Type: CopyBinary}); err != nil {
+		t.Error(err)
+	} else if !bytes.HasPrefix(b.Bytes(), copyBinaryHeader) {
+		t.Errorf("got %v", b.Bytes())
+	}
+}
+func TestGetSchema(t *testing.T) {
+	ahelper := dbhelper.NewDBHelper(driver, dns)
+	if err := ahelper.Open(); err != nil {
+		t.Error(err)
+	}
+	defer ahelper.Close()
+	meta := NewPgMeta()
+	meta.DBHelper = ahelper
+	if err := ahelper.GoExec(`
+drop table IF EXISTS b
+go
+drop table IF EXISTS a
+go
+create table a(
+	id bigint not null,
+	name varchar(200) check (name <> ''),
+	primary key(id)
+)
+go
+create table b(
+	id bigint not null,
+	aid bigint references a(id),
+	code varchar(20) unique,
+	primary key(id)
+)
+go
+create index b_aid on b(aid)
+go
+comment on table a is 'table a'`); err != nil {
+		t.Error(err)
+	}
+	schema, err := meta.GetSchema("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := schema.Table("a"), schema.Table("b")
+	if a == nil || b == nil {
+		t.Fatalf("got %#v", schema.Tables)
+	}
+	if len(a.Columns) != 2 || a.Columns[1].MaxSize != 200 || len(a.Checks) != 1 || len(a.PK) != 1 {
+		t.Errorf("got %#v", a)
+	}
+	if len(b.ForeignKeys) != 1 || b.ForeignKeys[0].RefTable != "a" || len(b.Uniques) != 1 ||
+		len(b.Indexes) != 1 || b.Indexes[0].Name != "b_aid" {
+		t.Errorf("got %#v", b)
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Schema{}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(loaded.Table("b").ForeignKeys, b.ForeignKeys) {
+		t.Errorf("got %#v", loaded.Table("b").ForeignKeys)
+	}
+}
+func TestDiffSchema(t *testing.T) {
+	meta := NewPgMeta()
+	column := func(name, dbType string, notNull bool) *Column {
+		rev := NewColumn(&dbhelper.TableColumn{Name: name, NotNull: notNull, Desc: dbhelper.DBDesc{}})
+		rev.DBType = dbType
+		return rev
+	}
+	from := &Schema{Desc: dbhelper.DBDesc{}, Tables: []*SchemaTable{
+		{
+			Table: Table{Name: "a", PK: []string{"id"}, Desc: dbhelper.DBDesc{}, Columns: []*Column{
+				column("id", "bigint", true), column("name", "character varying(200)", false)}},
+			Indexes: []*IndexDefine{{Name: "a_name", Keys: []string{`"name"`}, Desc: dbhelper.DBDesc{}}},
+		},
+		{Table: Table{Name: "c", Desc: dbhelper.DBDesc{}, Columns: []*Column{column("id", "bigint", true)}}},
+	}}
+	to := &Schema{Desc: dbhelper.DBDesc{}, Tables: []*SchemaTable{
+		{
+			Table: Table{Name: "a", PK: []string{"id"}, Desc: dbhelper.DBDesc{}, Columns: []*Column{
+				column("id", "bigint", true), column("name", "character varying(200)", false), column("code", "text", false)}},
+		},
+		{
+			Table: Table{Name: "b", PK: []string{"id"}, Desc: dbhelper.DBDesc{}, Columns: []*Column{
+				column("id", "bigint", true), column("aid", "bigint", false)}},
+			ForeignKeys: []*ForeignKey{{Name: "b_aid_fkey", Columns: []string{"aid"}, RefTable: "a", RefColumns: []string{"id"}}},
+		},
+	}}
+	diff := meta.DiffSchema(from, to)
+	got := make([]string, len(diff.Changes))
+	for i, v := range diff.Changes {
+		got[i] = v.String()
+	}
+	want := []string{
+		`removed the table "c"`,
+		`added the column "code" of the table "a"`,
+		`removed the index "a_name" of the table "a"`,
+		`added the table "b"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %s", strings.Join(got, "\n"))
+	}
+	for _, v := range []struct {
+		change *SchemaChange
+		want   string
+	}{
+		{&SchemaChange{Kind: DiffChanged, Object: DiffComment}, "changed the schema comment"},
+		{&SchemaChange{Kind: DiffChanged, Object: DiffPrimaryKey, Table: "a"}, `changed the primary key of the table "a"`},
+	} {
+		if got := v.change.String(); got != v.want {
+			t.Errorf("got %s", got)
+		}
+	}
+	meta.Plan = &Plan{}
+	if err := meta.ApplySchemaDiff("s", diff); err != nil {
+		t.Fatal(err)
+	}
+	sqls := make([]string, len(meta.Plan.Steps))
+	for i, v := range meta.Plan.Steps {
+		sqls[i] = strings.Fields(v.SQL)[0] + " " + strings.Fields(v.SQL)[1]
+	}
+	if strings.Join(sqls, ",") != "DROP TABLE,CREATE TABLE,DROP INDEX,ALTER TABLE,ALTER TABLE" ||
+		!strings.Contains(meta.Plan.Steps[4].SQL, `FOREIGN KEY("aid") REFERENCES "s"."a"("id")`) {
+		t.Errorf("got %s", meta.Plan)
+	}
+}
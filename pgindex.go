@@ -0,0 +1,307 @@
+package pghelper
+
+import (
+	"fmt"
+	"github.com/linlexing/dbhelper"
+	"regexp"
+	"strings"
+)
+
+// IndexDefine is the index with the PostgreSQL features that dbhelper.Index not modeled
+type IndexDefine struct {
+	Name   string
+	Unique bool
+	// Method is the access method,e.g. btree,gin,gist,brin,hash.empty means btree
+	Method string
+	// Keys are the key columns or expressions with the opclass and ordering,
+	// e.g. lower(email),"Name" DESC NULLS LAST,tags gin_trgm_ops.
+	// the keys are SQL text,so the column name need quoted by QuoteIdent
+	Keys []string
+	// Include are the non-key columns of the covering index
+	Include []string
+	// Where is the predicate of the partial index
+	Where string
+	Desc  dbhelper.DBDesc
+}
+
+var regSimpleIdent = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+func (p *PgMeta) indexDefine(tablename string, index *IndexDefine) string {
+	uniqueStr := ""
+	if index.Unique {
+		uniqueStr = "UNIQUE "
+	}
+	concurrentlyStr := ""
+	if p.ConcurrentIndex {
+		concurrentlyStr = "CONCURRENTLY "
+	}
+	rev := fmt.Sprintf("CREATE %sINDEX %s%s ON %s", uniqueStr, concurrentlyStr, p.QuoteIdent(index.Name), p.QuoteTableName(tablename))
+	if index.Method != "" && index.Method != "btree" {
+		rev += " USING " + index.Method
+	}
+	rev += "(" + strings.Join(index.Keys, ",") + ")"
+	if len(index.Include) > 0 {
+		rev += " INCLUDE(" + strings.Join(p.QuoteIdents(index.Include), ",") + ")"
+	}
+	if index.Where != "" {
+		rev += " WHERE " + index.Where
+	}
+	return rev
+}
+
+// GetIndexDefines return the indexes of the table,the primary key and the constraint's index are not included
+func (p *PgMeta) GetIndexDefines(tablename string) ([]*IndexDefine, error) {
+	table, err := p.DBHelper.GetData(SQL_TableIndexes, p.QuoteTableName(tablename))
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]*IndexDefine, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		if rev[i], err = indexFromRow(table.Row(i)); err != nil {
+			return nil, err
+		}
+	}
+	return rev, nil
+}
+
+// indexFromRow build the index from the row of the SQL_TableIndexes
+func indexFromRow(row map[string]interface{}) (*IndexDefine, error) {
+	rev := &IndexDefine{
+		Name:   row["indexname"].(string),
+		Unique: row["unique"].(bool),
+		Method: row["method"].(string),
+		Where:  row["predicate"].(string),
+		Desc:   dbhelper.DBDesc{},
+	}
+	var err error
+	if rev.Keys, rev.Include, err = parseIndexDef(row["define"].(string)); err != nil {
+		return nil, err
+	}
+	for j, v := range rev.Include {
+		rev.Include[j] = unquoteIdent(v)
+	}
+	if row["desc"] != nil {
+		rev.Desc.Parse(row["desc"].(string))
+	}
+	return rev, nil
+}
+
+// CreateIndexDefine create the index of the table,
+// with the ConcurrentIndex the invalid index left by the failed build is dropped
+func (p *PgMeta) CreateIndexDefine(tablename string, index *IndexDefine) error {
+	batch := &ddlBatch{}
+	batch.add(fmt.Sprintf("create the index %q of the table %q", index.Name, tablename), p.indexDefine(tablename, index))
+	if p.ConcurrentIndex {
+		batch.cleanup = append(batch.cleanup, &PlanStep{
+			Desc:         fmt.Sprintf("drop the invalid index %q", index.Name),
+			SQL:          fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", p.quoteIndexName(tablename, index.Name)),
+			InvalidIndex: &InvalidIndex{Table: tablename, Name: index.Name},
+		})
+	}
+	if err := p.execBatch(batch, false); err != nil {
+		return err
+	}
+	return p.commentIndex(tablename, index.Name, index.Desc)
+}
+
+// commentIndex set the comment of the index,the empty desc remove the comment
+func (p *PgMeta) commentIndex(tablename, indexname string, indexDesc dbhelper.DBDesc) error {
+	desc := fmt.Sprintf("comment the index %q", indexname)
+	if indexDesc.IsEmpty() {
+		return p.exec(desc, fmt.Sprintf("COMMENT ON INDEX %s IS NULL", p.quoteIndexName(tablename, indexname)), false)
+	} else {
+		return p.exec(desc, fmt.Sprintf(SQL_AlterIndexDesc, p.quoteIndexName(tablename, indexname), p.StringExpress(indexDesc.String())), false)
+	}
+}
+
+// AlterIndexDefine replace the index of the table.
+// with the ConcurrentIndex the new index is built under a temporary name first,
+// then the old index is dropped and the new one renamed,so the table is never left without the index
+func (p *PgMeta) AlterIndexDefine(tablename string, oldIndex, newIndex *IndexDefine) error {
+	if !p.ConcurrentIndex {
+		if err := p.DropIndex(tablename, oldIndex.Name); err != nil {
+			return err
+		}
+		return p.CreateIndexDefine(tablename, newIndex)
+	}
+	tmpIndex := *newIndex
+	tmpIndex.Name = shadowName(newIndex.Name, "_pghelper_tmp")
+	//the temporary index left by the failed replacement is dropped,valid or not,
+	//otherwise the retry fail on the existing name
+	if err := p.exec(fmt.Sprintf("drop the leftover index %q", tmpIndex.Name),
+		fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", p.quoteIndexName(tablename, tmpIndex.Name)), true); err != nil {
+		return err
+	}
+	if err := p.CreateIndexDefine(tablename, &tmpIndex); err != nil {
+		return err
+	}
+	if err := p.DropIndex(tablename, oldIndex.Name); err != nil {
+		return err
+	}
+	return p.exec(fmt.Sprintf("rename the index %q to %q", tmpIndex.Name, newIndex.Name),
+		fmt.Sprintf("ALTER INDEX %s RENAME TO %s", p.quoteIndexName(tablename, tmpIndex.Name), p.QuoteIdent(newIndex.Name)), false)
+}
+
+// DropInvalidIndexes drop the invalid indexes(indisvalid = false) of the table,
+// they are left by the failed CREATE INDEX CONCURRENTLY,return the dropped index names
+func (p *PgMeta) DropInvalidIndexes(tablename string) ([]string, error) {
+	return p.dropInvalidIndex(tablename, "")
+}
+
+// invalidIndexes return the invalid indexes of the table,empty name means all
+func (p *PgMeta) invalidIndexes(tablename, indexname string) ([]string, error) {
+	table, err := p.DBHelper.GetData(SQL_TableInvalidIndexes, p.QuoteTableName(tablename), indexname)
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]string, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		rev[i] = table.Row(i)["indexname"].(string)
+	}
+	return rev, nil
+}
+
+// dropInvalidIndex drop the invalid index of the name,empty name means all
+func (p *PgMeta) dropInvalidIndex(tablename, indexname string) ([]string, error) {
+	names, err := p.invalidIndexes(tablename, indexname)
+	if err != nil {
+		return nil, err
+	}
+	rev := []string{}
+	for _, name := range names {
+		if err := p.exec(fmt.Sprintf("drop the invalid index %q", name),
+			fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", p.quoteIndexName(tablename, name)), true); err != nil {
+			return rev, err
+		}
+		rev = append(rev, name)
+	}
+	return rev, nil
+}
+
+// shadowName return the name of the temporary object built beside the named one,
+// e.g. the replacement index or the shadow column,
+// the name is truncated to the 63 bytes limit of the identifier
+func shadowName(name, suffix string) string {
+	if len(name)+len(suffix) > 63 {
+		name = name[:63-len(suffix)]
+	}
+	return name + suffix
+}
+
+// parseIndexDef return the keys and the include columns of the pg_get_indexdef output,e.g.
+// CREATE INDEX a_idx ON public.a USING gin (lower(name) gin_trgm_ops) INCLUDE (id) WHERE ...
+func parseIndexDef(define string) (keys, include []string, err error) {
+	i := strings.Index(define, " USING ")
+	if i < 0 {
+		return nil, nil, fmt.Errorf("the index define %q invalid", define)
+	}
+	rest := define[i+len(" USING "):]
+	var body string
+	if body, rest, err = cutParentheses(rest); err != nil {
+		return nil, nil, fmt.Errorf("the index define %q invalid:%s", define, err)
+	}
+	keys = splitTopLevel(body)
+	if strings.HasPrefix(rest, " INCLUDE ") {
+		if body, _, err = cutParentheses(rest); err != nil {
+			return nil, nil, fmt.Errorf("the index define %q invalid:%s", define, err)
+		}
+		include = splitTopLevel(body)
+	}
+	return
+}
+
+// cutParentheses return the content of the first parentheses and the text after it,
+// the parentheses in the quoted text are skipped
+func cutParentheses(str string) (body, rest string, err error) {
+	start := strings.Index(str, "(")
+	if start < 0 {
+		return "", "", fmt.Errorf("missing (")
+	}
+	depth := 0
+	var quote rune
+	for i, c := range str[start:] {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return str[start+1 : start+i], str[start+i+1:], nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("missing )")
+}
+
+// splitTopLevel split the text by the comma not in the parentheses or the quoted text
+func splitTopLevel(str string) []string {
+	rev := []string{}
+	depth, last := 0, 0
+	var quote rune
+	for i, c := range str {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			rev = append(rev, strings.TrimSpace(str[last:i]))
+			last = i + 1
+		}
+	}
+	return append(rev, strings.TrimSpace(str[last:]))
+}
+
+// unquoteIdent return the name of the identifier,the quoted identifier is unquoted,
+// return empty if the text is not a single identifier(e.g. an expression)
+func unquoteIdent(str string) string {
+	if regSimpleIdent.MatchString(str) {
+		return str
+	}
+	if len(str) > 1 && str[0] == '"' && str[len(str)-1] == '"' {
+		inner := str[1 : len(str)-1]
+		if !strings.Contains(strings.Replace(inner, `""`, "", -1), `"`) {
+			return strings.Replace(inner, `""`, `"`, -1)
+		}
+	}
+	return ""
+}
+
+// indexKeys is the inverse of the indexColumns,quote the column names and keep the keys as is,
+// e.g. the quoted identifier,the expression lower(email) or the "Name" DESC
+func (p *PgMeta) indexKeys(columns []string) []string {
+	rev := make([]string, len(columns))
+	for i, v := range columns {
+		if strings.ContainsAny(v, "\"( \t\n") {
+			rev[i] = v
+		} else {
+			rev[i] = p.QuoteIdent(v)
+		}
+	}
+	return rev
+}
+
+// indexColumns return the column names of the keys,the expression is returned as is
+func indexColumns(keys []string) []string {
+	rev := make([]string, len(keys))
+	for i, v := range keys {
+		if name := unquoteIdent(v); name != "" {
+			rev[i] = name
+		} else {
+			rev[i] = v
+		}
+	}
+	return rev
+}
@@ -0,0 +1,744 @@
+package pghelper
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/linlexing/dbhelper"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// MergeStrategy is the statement used by the merge
+type MergeStrategy string
+
+const (
+	// MergeAuto choose the strategy by the server version:
+	// MergeNative on PostgreSQL 15+,otherwise MergeCTE.
+	// the MergeOnConflict replace the MergeCTE on 9.5+,and the MergeNative on PostgreSQL 15/16 with the ReturnKeys,
+	// only if the PKColumns are exactly the columns of a unique index of the dest
+	MergeAuto MergeStrategy = ""
+	// MergeCTE is the UPDATE ... RETURNING followed by an anti-join INSERT,
+	// it is racy under the concurrent writers
+	MergeCTE MergeStrategy = "cte"
+	// MergeOnConflict is the INSERT ... ON CONFLICT DO UPDATE,
+	// the key columns must be covered by a unique constraint or index
+	MergeOnConflict MergeStrategy = "on_conflict"
+	// MergeNative is the MERGE statement of PostgreSQL 15+
+	MergeNative MergeStrategy = "merge"
+)
+
+// MergeOptions describe how the source table is merged into the dest table
+type MergeOptions struct {
+	Dest   string
+	Source string
+	// Columns are the columns copied from the source to the dest
+	Columns []string
+	// PKColumns are the key columns that match the source row to the dest row,
+	// they may be the columns of any unique constraint or index of the dest
+	PKColumns []string
+	// AutoUpdate update the matched rows,otherwise only the new rows are inserted
+	AutoUpdate bool
+	// AutoRemove delete the dest rows not in the source
+	AutoRemove bool
+	// SourceColumns map the dest column to the SQL expression of the source,the source table is aliased as src,
+	// e.g. {"name": "src.full_name", "deleted": "false"}.the unmapped column read the source column of the same name
+	SourceColumns map[string]string
+	// SoftDelete mark the dest rows not in the source instead of deleting them by the AutoRemove,
+	// it map the dest column to the SQL expression,e.g. {"deleted": "true", "deleted_at": "now()"}.
+	// the rows already marked are skipped and not counted as deleted,see the SoftDeleted
+	SoftDelete map[string]string
+	// SoftDeleted is the condition of the rows already marked by the SoftDelete,the dest table is aliased as dest,
+	// e.g. "dest.deleted".empty means the rows that all the SoftDelete columns equal the values as the text,
+	// it must be set if any value is volatile like now()
+	SoftDeleted string
+	// Where limit the dest rows deleted by the AutoRemove,the dest table is aliased as dest.
+	// it may have the placeholders($1,$2... see ParamPlaceholder) bound to the WhereArgs
+	Where     string
+	WhereArgs []interface{}
+	// WhereAll apply the Where to the updated and inserted rows too,
+	// the inserted row is checked on the source values of the Columns aliased as dest
+	WhereAll bool
+	Strategy MergeStrategy
+	// OnlyChanged skip the matched rows that all the update columns equal the source,
+	// so the unchanged rows are not rewritten and not counted as updated.
+	// the values are compared as the text,so the source expression of another type may count as changed
+	OnlyChanged bool
+	// ReturnKeys return the primary keys of the affected rows in the MergeResult
+	ReturnKeys bool
+	// the key range conditions of the batch on the source and the dest,set by the MergeBatched
+	srcRange, destRange string
+	// uniqueKey means the PKColumns are the columns of a unique index of the dest,set by the merge
+	uniqueKey bool
+}
+
+// MergeResult is the row counts of the merge
+type MergeResult struct {
+	Inserted, Updated, Deleted int64
+	// the primary keys of the affected rows,only filled with the ReturnKeys
+	InsertedKeys, UpdatedKeys, DeletedKeys []map[string]interface{}
+}
+
+const (
+	// the server versions of the merge features
+	versionOnConflict     = 90500
+	versionMerge          = 150000
+	versionMergeReturning = 170000
+)
+
+var mergeFuncs = template.FuncMap{
+	"Join": func(value []string, sep, prefix string) string {
+		if prefix == "" {
+			return strings.Join(value, sep)
+		} else {
+			rev := make([]string, len(value))
+			for i, v := range value {
+				rev[i] = prefix + v
+			}
+			return strings.Join(rev, sep)
+		}
+	},
+}
+
+var mergeTemplate = template.Must(template.New("merge").Funcs(mergeFuncs).Parse(`
+{{define "delete"}}{{if ne .softDelete ""}}
+UPDATE {{.destTable}} dest SET
+        {{.softDelete}}
+    WHERE
+    {{.softDeleteCond}} AND{{else}}
+DELETE FROM {{.destTable}} dest WHERE{{end}}{{if ne .destRange ""}}
+    {{.destRange}} AND {{end}}{{if ne .sqlWhere ""}}
+    ({{.sqlWhere}}) AND {{end}}
+    NOT EXISTS(
+        SELECT 1 FROM {{.sourceTable}} src WHERE {{.pkJoin}}
+    ){{end}}
+{{define "matched"}}
+SELECT count(*) FROM {{.destTable}} dest JOIN {{.sourceTable}} src ON {{.pkJoin}}{{if ne .updateCond ""}}
+WHERE {{.updateCond}}{{end}}{{end}}
+{{define "result"}}{{if .returnKeys}}{{if .doUpdate}}
+SELECT 'UPDATE' AS pghelper_action,{{Join .pkColumns "," ""}} FROM updated
+UNION ALL{{end}}{{if .autoRemove}}
+SELECT 'DELETE' AS pghelper_action,{{Join .pkColumns "," ""}} FROM deleted
+UNION ALL{{end}}
+SELECT 'INSERT' AS pghelper_action,{{Join .pkColumns "," ""}} FROM inserted{{else}}
+SELECT
+    {{if .doUpdate}}(SELECT count(*) FROM updated){{else}}0{{end}} AS updated,
+    (SELECT count(*) FROM inserted) AS inserted,
+    {{if .autoRemove}}(SELECT count(*) FROM deleted){{else}}0{{end}} AS deleted{{end}}{{end}}
+{{define "deleted"}}deleted as ({{template "delete" .}}
+    RETURNING {{Join .pkColumns "," "dest."}}
+),
+{{end}}
+{{define "cte"}}
+WITH {{if .autoRemove}}{{template "deleted" .}}{{end}}{{if .doUpdate}}updated as (
+    UPDATE {{.destTable}} dest SET
+        {{.updateSet}}
+    FROM {{.sourceTable}} src
+    WHERE {{.pkJoin}}{{if ne .updateCond ""}}
+        AND {{.updateCond}}{{end}}
+    RETURNING {{Join .pkColumns "," "dest."}}
+),
+{{end}}inserted as (
+INSERT INTO {{.destTable}}(
+    {{Join .colNames ",\n    " ""}}
+)
+SELECT
+    {{Join .srcValues ",\n    " ""}}
+FROM
+    {{.sourceTable}} src
+WHERE NOT EXISTS(
+    SELECT 1 FROM {{.destTable}} dest WHERE {{.pkJoin}}
+){{if ne .insertCond ""}} AND
+    {{.insertCond}}{{end}}
+RETURNING {{Join .pkColumns "," ""}}
+){{template "result" .}}{{end}}
+{{define "on_conflict"}}
+WITH {{if .autoRemove}}{{template "deleted" .}}{{end}}upserted as (
+INSERT INTO {{.destTable}} AS dest(
+    {{Join .colNames ",\n    " ""}}
+)
+SELECT
+    {{Join .srcValues ",\n    " ""}}
+FROM
+    {{.sourceTable}} src{{if ne .insertCond ""}}
+WHERE {{.insertCond}}{{end}}
+ON CONFLICT({{Join .pkColumns "," ""}}) DO {{if .doUpdate}}UPDATE SET
+        {{.excludedSet}}{{if ne .excludedCond ""}}
+    WHERE {{.excludedCond}}{{end}}{{else}}NOTHING{{end}}
+RETURNING {{Join .pkColumns "," ""}},(xmax = 0) AS pghelper_inserted
+),
+inserted as (SELECT * FROM upserted WHERE pghelper_inserted),
+updated as (SELECT * FROM upserted WHERE NOT pghelper_inserted){{template "result" .}}{{end}}
+{{define "mergeBody"}}
+MERGE INTO {{.destTable}} dest
+USING {{.sourceTable}} src ON {{.pkJoin}}
+{{if .doUpdate}}WHEN MATCHED{{if ne .updateCond ""}} AND {{.updateCond}}{{end}} THEN
+    UPDATE SET
+        {{.updateSet}}
+{{end}}WHEN NOT MATCHED{{if ne .insertCond ""}} AND {{.insertCond}}{{end}} THEN
+    INSERT({{Join .colNames "," ""}})
+    VALUES({{Join .srcValues "," ""}}){{if .removeBySource}}
+WHEN NOT MATCHED BY SOURCE{{if ne .destRange ""}} AND {{.destRange}}{{end}}{{if ne .sqlWhere ""}} AND ({{.sqlWhere}}){{end}} THEN
+    DELETE{{end}}{{end}}
+{{define "merge"}}{{if .mergeReturning}}
+WITH {{if (and .autoRemove (not .removeBySource))}}{{template "deleted" .}}{{end}}merged as ({{template "mergeBody" .}}
+RETURNING merge_action() AS pghelper_action,{{Join .pkColumns "," "dest."}}
+),
+inserted as (SELECT * FROM merged WHERE pghelper_action = 'INSERT'),
+updated as (SELECT * FROM merged WHERE pghelper_action = 'UPDATE'){{if .removeBySource}},
+deleted as (SELECT * FROM merged WHERE pghelper_action = 'DELETE'){{end}}{{template "result" .}}{{else}}{{template "mergeBody" .}}{{end}}{{end}}`))
+
+// ServerVersion return the server_version_num of the server,e.g. 150002.
+// it is queried once and cached by the PgMeta
+func (p *PgMeta) ServerVersion() (int, error) {
+	if version := atomic.LoadInt32(&p.serverVersion); version > 0 {
+		return int(version), nil
+	}
+	v, err := p.DBHelper.QueryOne("SHOW server_version_num")
+	if err != nil {
+		return 0, err
+	}
+	version, err := valueInt64(v)
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreInt32(&p.serverVersion, int32(version))
+	return int(version), nil
+}
+
+// mergeStrategy return the strategy used on the server version,
+// the ON CONFLICT is chosen only with the unique index of the key columns
+func mergeStrategy(opts *MergeOptions, version int) MergeStrategy {
+	if opts.Strategy != MergeAuto {
+		return opts.Strategy
+	}
+	switch {
+	case version >= versionMergeReturning:
+		return MergeNative
+	case version >= versionMerge && !opts.ReturnKeys:
+		return MergeNative
+	case version >= versionOnConflict && opts.uniqueKey:
+		return MergeOnConflict
+	default:
+		return MergeCTE
+	}
+}
+
+// uniqueKeyExists return true if the key columns are exactly the columns of a unique index of the table,
+// it can be the arbiter of the ON CONFLICT
+func (p *PgMeta) uniqueKeyExists(tablename string, columns []string) (bool, error) {
+	v, err := p.DBHelper.QueryOne(SQL_UniqueKeyExists, p.QuoteTableName(tablename), strings.Join(columns, ","))
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+func (p *PgMeta) Merge(dest, source string, colNames []string, pkColumns []string, autoUpdate, autoRemove bool, sqlWhere string) error {
+	_, err := p.MergeWith(&MergeOptions{
+		Dest:       dest,
+		Source:     source,
+		Columns:    colNames,
+		PKColumns:  pkColumns,
+		AutoUpdate: autoUpdate,
+		AutoRemove: autoRemove,
+		Where:      sqlWhere,
+	})
+	return err
+}
+
+// MergeWith is the Merge with the options,the statement is chosen by the Strategy.
+// return the row counts of the merge,and the affected keys with the ReturnKeys
+func (p *PgMeta) MergeWith(opts *MergeOptions) (*MergeResult, error) {
+	return p.merge(opts, false)
+}
+
+// merge run the merge,the MERGE of PostgreSQL 15/16 need a transaction,
+// it is began here unless inTx
+func (p *PgMeta) merge(opts *MergeOptions, inTx bool) (*MergeResult, error) {
+	version := 0
+	if opts.Strategy == MergeAuto || opts.Strategy == MergeNative {
+		var err error
+		if version, err = p.ServerVersion(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Strategy == MergeAuto && version >= versionOnConflict &&
+		(version < versionMerge || opts.ReturnKeys && version < versionMergeReturning) {
+		withKey := *opts
+		var err error
+		if withKey.uniqueKey, err = p.uniqueKeyExists(opts.Dest, opts.PKColumns); err != nil {
+			return nil, err
+		}
+		opts = &withKey
+	}
+	stmts, err := p.mergeSQL(opts, version)
+	if err != nil {
+		return nil, err
+	}
+	if stmts.matchedSQL == "" {
+		table, err := p.DBHelper.GetData(stmts.sql, stmts.args...)
+		if err != nil {
+			return nil, err
+		}
+		return newMergeResult(table, opts.ReturnKeys)
+	}
+	if inTx {
+		return p.mergeLegacy(stmts)
+	}
+	if err := p.DBHelper.Begin(); err != nil {
+		return nil, err
+	}
+	rev, err := p.mergeLegacy(stmts)
+	if err != nil {
+		if rbErr := p.DBHelper.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("%s,and rollback fail:%s", err, rbErr)
+		}
+		return nil, err
+	}
+	return rev, p.DBHelper.Commit()
+}
+
+// MergeTable merge the rows into the dest table in a transaction:
+// the rows are copied into a temporary staging table by the COPY protocol,then merged by the opts.
+// the Columns default to all the columns of the rows,the PKColumns default to the primary key of the rows.
+// the staging table is created even in the dry-run mode,it is not a part of the Plan
+func (p *PgMeta) MergeTable(dest string, rows *dbhelper.DataTable, opts *MergeOptions) (*MergeResult, error) {
+	_, table := splitTableName(dest)
+	staging := NewTable(rows)
+	staging.Name = shadowName(table, "_pghelper_src")
+	staging.PK = nil
+	staging.Temporary = true
+	staging.Desc = dbhelper.DBDesc{}
+	for _, v := range staging.Columns {
+		v.NotNull = false
+		v.Desc = dbhelper.DBDesc{}
+	}
+	mergeOpts := MergeOptions{}
+	if opts != nil {
+		mergeOpts = *opts
+	}
+	mergeOpts.Dest = dest
+	mergeOpts.Source = staging.Name
+	if len(mergeOpts.Columns) == 0 {
+		mergeOpts.Columns = make([]string, len(rows.Columns))
+		for i, v := range rows.Columns {
+			mergeOpts.Columns[i] = v.Name
+		}
+	}
+	if len(mergeOpts.PKColumns) == 0 && rows.HasPrimaryKey() {
+		mergeOpts.PKColumns = rows.PK
+	}
+
+	if err := p.DBHelper.Begin(); err != nil {
+		return nil, err
+	}
+	rev, err := p.mergeStaging(staging, rows, &mergeOpts)
+	if err != nil {
+		if rbErr := p.DBHelper.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("%s,and rollback fail:%s", err, rbErr)
+		}
+		return nil, err
+	}
+	return rev, p.DBHelper.Commit()
+}
+func (p *PgMeta) mergeStaging(staging *Table, rows *dbhelper.DataTable, opts *MergeOptions) (*MergeResult, error) {
+	if err := p.createTableDefine(staging, false); err != nil {
+		return nil, err
+	}
+	if err := p.copyRows(staging.Name, rows); err != nil {
+		return nil, fmt.Errorf("copy the rows into %q fail:%s", staging.Name, err)
+	}
+	if _, err := p.DBHelper.Exec("ANALYZE " + p.QuoteTableName(staging.Name)); err != nil {
+		return nil, err
+	}
+	return p.merge(opts, true)
+}
+
+// mergeLegacy run the MERGE of PostgreSQL 15/16 that has no RETURNING,
+// the updated rows are counted before the MERGE
+func (p *PgMeta) mergeLegacy(stmts *mergeStatements) (*MergeResult, error) {
+	rev := &MergeResult{}
+	if stmts.deleteSQL != "" {
+		result, err := p.DBHelper.Exec(stmts.deleteSQL, stmts.deleteArgs...)
+		if err != nil {
+			return nil, err
+		}
+		if rev.Deleted, err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+	if stmts.doUpdate {
+		v, err := p.DBHelper.QueryOne(stmts.matchedSQL, stmts.matchedArgs...)
+		if err != nil {
+			return nil, err
+		}
+		if rev.Updated, err = valueInt64(v); err != nil {
+			return nil, err
+		}
+	}
+	result, err := p.DBHelper.Exec(stmts.sql, stmts.args...)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	rev.Inserted = affected - rev.Updated
+	return rev, nil
+}
+
+// mergeStatements is the statements of the merge
+type mergeStatements struct {
+	// sql is the merge statement,it return the result rows except the MERGE of PostgreSQL 15/16
+	sql string
+	// deleteSQL is the DELETE run before the MERGE of PostgreSQL 15/16
+	deleteSQL string
+	// matchedSQL count the rows that the MERGE of PostgreSQL 15/16 will update
+	matchedSQL string
+	// the WhereArgs of the statements that have the Where
+	args, deleteArgs, matchedArgs []interface{}
+	doUpdate                      bool
+}
+
+// mergeSQL return the statements of the merge on the server version
+func (p *PgMeta) mergeSQL(opts *MergeOptions, version int) (*mergeStatements, error) {
+	if len(opts.PKColumns) == 0 {
+		return nil, fmt.Errorf("the primary keys is empty")
+	}
+	if len(opts.Columns) == 0 {
+		return nil, fmt.Errorf("the columns is empty")
+	}
+	//the source value of the dest column
+	srcValue := func(column string) string {
+		if v, ok := opts.SourceColumns[column]; ok {
+			return v
+		}
+		return "src." + p.QuoteIdent(column)
+	}
+	srcValues := make([]string, len(opts.Columns))
+	for i, v := range opts.Columns {
+		srcValues[i] = srcValue(v)
+	}
+	pkJoin := make([]string, len(opts.PKColumns))
+	for i, v := range opts.PKColumns {
+		pkJoin[i] = fmt.Sprintf("dest.%s=%s", p.QuoteIdent(v), srcValue(v))
+	}
+	//primary key not update
+	updateColumns := []string{}
+	updateSet := []string{}
+	excludedSet := []string{}
+	destValues := []string{}
+	updateValues := []string{}
+	excludedValues := []string{}
+	for i, v := range opts.Columns {
+		bFound := false
+		for _, pv := range opts.PKColumns {
+			if v == pv {
+				bFound = true
+				break
+			}
+		}
+		if !bFound {
+			name := p.QuoteIdent(v)
+			updateColumns = append(updateColumns, v)
+			updateSet = append(updateSet, fmt.Sprintf("%s = %s", name, srcValues[i]))
+			excludedSet = append(excludedSet, fmt.Sprintf("%s = EXCLUDED.%s", name, name))
+			destValues = append(destValues, "dest."+name)
+			updateValues = append(updateValues, srcValues[i])
+			excludedValues = append(excludedValues, "EXCLUDED."+name)
+		}
+	}
+	softDeleteColumns := make([]string, 0, len(opts.SoftDelete))
+	for k := range opts.SoftDelete {
+		softDeleteColumns = append(softDeleteColumns, k)
+	}
+	sort.Strings(softDeleteColumns)
+	softDelete := make([]string, len(softDeleteColumns))
+	softDeleteDest := make([]string, len(softDeleteColumns))
+	softDeleteValues := make([]string, len(softDeleteColumns))
+	for i, v := range softDeleteColumns {
+		softDelete[i] = fmt.Sprintf("%s = %s", p.QuoteIdent(v), opts.SoftDelete[v])
+		softDeleteDest[i] = "dest." + p.QuoteIdent(v)
+		softDeleteValues[i] = opts.SoftDelete[v]
+	}
+	//the condition of the rows not marked yet
+	softDeleteCond := ""
+	switch {
+	case len(softDelete) == 0:
+	case opts.SoftDeleted != "":
+		softDeleteCond = fmt.Sprintf("(%s) IS NOT TRUE", opts.SoftDeleted)
+	default:
+		softDeleteCond = fmt.Sprintf("ROW(%s) IS DISTINCT FROM ROW(%s)", textValues(softDeleteDest), textValues(softDeleteValues))
+	}
+	strategy := mergeStrategy(opts, version)
+	//the MERGE before PostgreSQL 17 has no RETURNING,the affected keys can not be returned
+	if strategy == MergeNative && version < versionMergeReturning && opts.ReturnKeys {
+		return nil, fmt.Errorf("the MERGE before PostgreSQL 17 can not return the keys")
+	}
+	//the conditions of the updated and inserted rows
+	updateCond := []string{}
+	excludedCond := []string{}
+	insertCond := ""
+	whereAll := opts.WhereAll && opts.Where != ""
+	if whereAll {
+		updateCond = append(updateCond, "("+opts.Where+")")
+		excludedCond = append(excludedCond, "("+opts.Where+")")
+		//check the Where on the row built from the source values,it has the merged columns only
+		newRow := make([]string, len(opts.Columns))
+		for i, v := range opts.Columns {
+			newRow[i] = srcValues[i] + " AS " + p.QuoteIdent(v)
+		}
+		insertCond = fmt.Sprintf("EXISTS(SELECT 1 FROM (SELECT %s) dest WHERE %s)", strings.Join(newRow, ","), opts.Where)
+	}
+	if opts.OnlyChanged {
+		//compare the text,the types like json and point have no equality operator
+		updateCond = append(updateCond, fmt.Sprintf("ROW(%s) IS DISTINCT FROM ROW(%s)", textValues(destValues), textValues(updateValues)))
+		excludedCond = append(excludedCond, fmt.Sprintf("ROW(%s) IS DISTINCT FROM ROW(%s)", textValues(destValues), textValues(excludedValues)))
+	}
+	legacy := strategy == MergeNative && version < versionMergeReturning
+	sourceTable := p.QuoteTableName(opts.Source)
+	if opts.srcRange != "" {
+		sourceTable = fmt.Sprintf("(SELECT * FROM %s src WHERE %s)", sourceTable, opts.srcRange)
+	}
+	rev := &mergeStatements{doUpdate: opts.AutoUpdate && len(updateColumns) > 0}
+	if whereAll || opts.Where != "" && opts.AutoRemove && !legacy {
+		rev.args = opts.WhereArgs
+	}
+	param := map[string]interface{}{
+		"destTable":      p.QuoteTableName(opts.Dest),
+		"sourceTable":    sourceTable,
+		"colNames":       p.QuoteIdents(opts.Columns),
+		"srcValues":      srcValues,
+		"pkColumns":      p.QuoteIdents(opts.PKColumns),
+		"pkJoin":         strings.Join(pkJoin, " AND "),
+		"updateSet":      strings.Join(updateSet, ",\n        "),
+		"excludedSet":    strings.Join(excludedSet, ",\n        "),
+		"updateCond":     strings.Join(updateCond, " AND "),
+		"excludedCond":   strings.Join(excludedCond, " AND "),
+		"insertCond":     insertCond,
+		"softDelete":     strings.Join(softDelete, ",\n        "),
+		"softDeleteCond": softDeleteCond,
+		"doUpdate":       rev.doUpdate,
+		"autoRemove":     opts.AutoRemove,
+		"mergeReturning": version >= versionMergeReturning,
+		//the soft delete is an UPDATE,it can not be told from the updated rows by the merge_action()
+		"removeBySource": opts.AutoRemove && len(softDelete) == 0 && version >= versionMergeReturning,
+		"returnKeys":     opts.ReturnKeys,
+		"sqlWhere":       opts.Where,
+		"destRange":      opts.destRange,
+	}
+	if legacy {
+		//the MERGE before PostgreSQL 17 can not delete the rows not in the source
+		var b bytes.Buffer
+		if opts.AutoRemove {
+			if err := mergeTemplate.ExecuteTemplate(&b, "delete", param); err != nil {
+				return nil, err
+			}
+			rev.deleteSQL = b.String()
+			if opts.Where != "" {
+				rev.deleteArgs = opts.WhereArgs
+			}
+			b.Reset()
+		}
+		if err := mergeTemplate.ExecuteTemplate(&b, "matched", param); err != nil {
+			return nil, err
+		}
+		rev.matchedSQL = b.String()
+		if whereAll {
+			rev.matchedArgs = opts.WhereArgs
+		}
+	}
+	var b bytes.Buffer
+	if err := mergeTemplate.ExecuteTemplate(&b, string(strategy), param); err != nil {
+		return nil, err
+	}
+	rev.sql = b.String()
+	return rev, nil
+}
+
+// textValues cast the SQL expressions to the text and join them by the comma
+func textValues(values []string) string {
+	rev := make([]string, len(values))
+	for i, v := range values {
+		rev[i] = "(" + v + ")::text"
+	}
+	return strings.Join(rev, ",")
+}
+
+// newMergeResult read the counts or the affected keys returned by the merge statement
+func newMergeResult(table *dbhelper.DataTable, returnKeys bool) (*MergeResult, error) {
+	rev := &MergeResult{}
+	if !returnKeys {
+		if table.RowCount() == 0 {
+			return rev, nil
+		}
+		row := table.Row(0)
+		var err error
+		if rev.Updated, err = valueInt64(row["updated"]); err != nil {
+			return nil, err
+		}
+		if rev.Inserted, err = valueInt64(row["inserted"]); err != nil {
+			return nil, err
+		}
+		if rev.Deleted, err = valueInt64(row["deleted"]); err != nil {
+			return nil, err
+		}
+		return rev, nil
+	}
+	for i := 0; i < table.RowCount(); i++ {
+		row := table.Row(i)
+		action := valueString(row["pghelper_action"])
+		delete(row, "pghelper_action")
+		switch action {
+		case "INSERT":
+			rev.Inserted++
+			rev.InsertedKeys = append(rev.InsertedKeys, row)
+		case "UPDATE":
+			rev.Updated++
+			rev.UpdatedKeys = append(rev.UpdatedKeys, row)
+		case "DELETE":
+			rev.Deleted++
+			rev.DeletedKeys = append(rev.DeletedKeys, row)
+		}
+	}
+	return rev, nil
+}
+
+// MergeBatch describe the batched merge
+type MergeBatch struct {
+	// Size is the source rows merged in a batch
+	Size int
+	// Checkpoint is the primary key values of the last merged source row,in the order of the PKColumns,
+	// the merge resume after it.nil means start from the first row
+	Checkpoint []interface{}
+	// Progress is called after every committed batch with the total result so far and the new checkpoint,
+	// save the checkpoint to resume the failed merge.return an error to stop the merge.
+	// the checkpoint is nil after the last batch,the merge is done
+	Progress func(result *MergeResult, checkpoint []interface{}) error
+}
+
+// MergeBatched merge the source in the primary key order by the batches,every batch run in its own transaction
+// and report the checkpoint to the Progress,a failed merge resume from the saved Checkpoint.
+// the AutoRemove of a batch only remove the dest rows in the key range of the batch
+func (p *PgMeta) MergeBatched(opts *MergeOptions, batch *MergeBatch) (*MergeResult, error) {
+	if batch.Size <= 0 {
+		return nil, fmt.Errorf("the batch size %d invalid", batch.Size)
+	}
+	if len(opts.PKColumns) == 0 {
+		return nil, fmt.Errorf("the primary keys is empty")
+	}
+	if batch.Checkpoint != nil && len(batch.Checkpoint) != len(opts.PKColumns) {
+		return nil, fmt.Errorf("the checkpoint has %d values,the primary keys has %d columns", len(batch.Checkpoint), len(opts.PKColumns))
+	}
+	srcKeys := make([]string, len(opts.PKColumns))
+	destKeys := make([]string, len(opts.PKColumns))
+	selectKeys := make([]string, len(opts.PKColumns))
+	for i, v := range opts.PKColumns {
+		if expr, ok := opts.SourceColumns[v]; ok {
+			srcKeys[i] = expr
+		} else {
+			srcKeys[i] = "src." + p.QuoteIdent(v)
+		}
+		destKeys[i] = "dest." + p.QuoteIdent(v)
+		selectKeys[i] = fmt.Sprintf("%s AS pghelper_key%d", srcKeys[i], i)
+	}
+	srcKey := "ROW(" + strings.Join(srcKeys, ",") + ")"
+	destKey := "ROW(" + strings.Join(destKeys, ",") + ")"
+	total := &MergeResult{}
+	checkpoint := batch.Checkpoint
+	for {
+		//the key of the last source row in the batch,nil if the rest rows are all in the batch
+		where := ""
+		if checkpoint != nil {
+			where = fmt.Sprintf(" WHERE %s > %s", srcKey, p.rowExpress(checkpoint))
+		}
+		table, err := p.DBHelper.GetData(fmt.Sprintf("SELECT %s FROM %s src%s ORDER BY %s OFFSET %d LIMIT 1",
+			strings.Join(selectKeys, ","), p.QuoteTableName(opts.Source), where, strings.Join(srcKeys, ","), batch.Size-1))
+		if err != nil {
+			return total, err
+		}
+		var last []interface{}
+		if table.RowCount() > 0 {
+			row := table.Row(0)
+			last = make([]interface{}, len(opts.PKColumns))
+			for i := range last {
+				last[i] = row[fmt.Sprintf("pghelper_key%d", i)]
+			}
+		}
+		srcRange := []string{}
+		destRange := []string{}
+		if checkpoint != nil {
+			srcRange = append(srcRange, srcKey+" > "+p.rowExpress(checkpoint))
+			destRange = append(destRange, destKey+" > "+p.rowExpress(checkpoint))
+		}
+		if last != nil {
+			srcRange = append(srcRange, srcKey+" <= "+p.rowExpress(last))
+			destRange = append(destRange, destKey+" <= "+p.rowExpress(last))
+		}
+		batchOpts := *opts
+		batchOpts.srcRange = strings.Join(srcRange, " AND ")
+		batchOpts.destRange = strings.Join(destRange, " AND ")
+		result, err := p.mergeBatch(&batchOpts)
+		if err != nil {
+			return total, err
+		}
+		total.Inserted += result.Inserted
+		total.Updated += result.Updated
+		total.Deleted += result.Deleted
+		total.InsertedKeys = append(total.InsertedKeys, result.InsertedKeys...)
+		total.UpdatedKeys = append(total.UpdatedKeys, result.UpdatedKeys...)
+		total.DeletedKeys = append(total.DeletedKeys, result.DeletedKeys...)
+		checkpoint = last
+		if batch.Progress != nil {
+			if err := batch.Progress(total, checkpoint); err != nil {
+				return total, err
+			}
+		}
+		if last == nil {
+			return total, nil
+		}
+	}
+}
+
+// mergeBatch run a batch of the MergeBatched in a transaction
+func (p *PgMeta) mergeBatch(opts *MergeOptions) (*MergeResult, error) {
+	if err := p.DBHelper.Begin(); err != nil {
+		return nil, err
+	}
+	rev, err := p.merge(opts, true)
+	if err != nil {
+		if rbErr := p.DBHelper.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("%s,and rollback fail:%s", err, rbErr)
+		}
+		return nil, err
+	}
+	return rev, p.DBHelper.Commit()
+}
+
+// rowExpress return the ROW of the literal values,the string literals are coerced to the key types by the server.
+// the checkpoint is inlined,so the placeholders of the Where keep their numbers
+func (p *PgMeta) rowExpress(values []interface{}) string {
+	rev := make([]string, len(values))
+	for i, v := range values {
+		switch tv := v.(type) {
+		case nil:
+			rev[i] = "NULL"
+		case bool:
+			rev[i] = strconv.FormatBool(tv)
+		case int, int32, int64, float32, float64:
+			rev[i] = fmt.Sprint(tv)
+		case time.Time:
+			rev[i] = "'" + tv.Format(time.RFC3339Nano) + "'"
+		case []byte:
+			rev[i] = p.StringExpress(string(tv))
+		default:
+			rev[i] = p.StringExpress(fmt.Sprint(tv))
+		}
+	}
+	return "ROW(" + strings.Join(rev, ",") + ")"
+}
@@ -6,23 +6,37 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/linlexing/datatable.go"
 	"github.com/linlexing/dbhelper"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 )
 
 type PgMeta struct {
 	*dbhelper.RootMeta
+	// Types map the catalog types to the datatable types,register the custom types here.
+	// nil means the builtin types
+	Types *TypeRegistry
+	// ConcurrentIndex build and drop the indexes with CONCURRENTLY,so the writes are not blocked.
+	// the statements can not run in a transaction
+	ConcurrentIndex bool
+	// OnlineTypeChange change the column type by a shadow column backfilled in the batches of the rows,
+	// so the large table is not rewritten under the exclusive lock.0 means the plain ALTER COLUMN TYPE
+	OnlineTypeChange int
+	// Plan switch on the dry-run mode,the mutators append the statements to it instead of executing them,
+	// the introspection still query the database.use ApplyPlan to execute the plan later
+	Plan *Plan
+	// serverVersion is the cached server_version_num,0 means not queried yet
+	serverVersion int32
 }
 
-var regVarchar = regexp.MustCompile(`^character varying\((\d+)\)$`)
-
 func init() {
 	dbhelper.RegisterMetaHelper("postgres", NewPgMeta())
 }
 func NewPgMeta() *PgMeta {
-	return &PgMeta{&dbhelper.RootMeta{}}
+	return &PgMeta{
+		RootMeta: &dbhelper.RootMeta{},
+		Types:    NewTypeRegistry(),
+	}
 }
 func (m *PgMeta) ParamPlaceholder(num int) string {
 	return "$" + strconv.Itoa(num)
@@ -30,49 +44,130 @@ func (m *PgMeta) ParamPlaceholder(num int) string {
 func (m *PgMeta) RegLike(value, strRegLike string) string {
 	return value + " ~ " + strRegLike
 }
+
+// splitTableName split the "schema.table" to schema and table,the schema is empty when not qualified
+func splitTableName(tablename string) (schema, table string) {
+	if i := strings.LastIndex(tablename, "."); i >= 0 {
+		return tablename[:i], tablename[i+1:]
+	}
+	return "", tablename
+}
+
+// QuoteIdent quote the identifier with double quotes,so mixed-case names,
+// reserved words and names with spaces are kept as is
+func (p *PgMeta) QuoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// QuoteIdents quote every identifier of the names
+func (p *PgMeta) QuoteIdents(names []string) []string {
+	rev := make([]string, len(names))
+	for i, v := range names {
+		rev[i] = p.QuoteIdent(v)
+	}
+	return rev
+}
+
+// QuoteTableName quote the table name,the schema part is quoted separately
+func (p *PgMeta) QuoteTableName(tablename string) string {
+	if schema, table := splitTableName(tablename); schema != "" {
+		return p.QuoteIdent(schema) + "." + p.QuoteIdent(table)
+	}
+	return p.QuoteIdent(tablename)
+}
+
+// quoteIndexName qualify the index name with the table's schema,
+// because the index always live in the schema of the table
+func (p *PgMeta) quoteIndexName(tablename, indexname string) string {
+	if schema, _ := splitTableName(tablename); schema != "" {
+		return p.QuoteIdent(schema) + "." + p.QuoteIdent(indexname)
+	}
+	return p.QuoteIdent(indexname)
+}
 func (p *PgMeta) TableExists(tablename string) (bool, error) {
-	return p.DBHelper.Exists(`
-	    SELECT 1
-	    FROM information_schema.tables
-	    WHERE
-	      table_schema = current_schema AND
-	      table_name = $1`, tablename)
+	schema, table := splitTableName(tablename)
+	rev, err := p.DBHelper.QueryOne(SQL_SchemaTableExists, schema, table)
+	if err != nil {
+		return false, err
+	}
+	return rev.(bool), nil
 }
 func (p *PgMeta) DropPrimaryKey(tablename string) error {
 	cname, err := p.getPrimaryKeyConstraintName(tablename)
 	if err != nil {
 		return err
 	}
-	_, err = p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", tablename, cname))
-	return err
+	return p.exec(fmt.Sprintf("drop the primary key %q of the table %q", cname, tablename),
+		fmt.Sprintf(SQL_DropConstraint, p.QuoteTableName(tablename), p.QuoteIdent(cname)), true)
 }
 func (p *PgMeta) DropIndex(tablename, indexname string) error {
-	_, err := p.DBHelper.Exec(fmt.Sprintf("DROP INDEX %s", indexname))
-	return err
+	desc := fmt.Sprintf("drop the index %q of the table %q", indexname, tablename)
+	if p.ConcurrentIndex {
+		return p.exec(desc, fmt.Sprintf("DROP INDEX CONCURRENTLY %s", p.quoteIndexName(tablename, indexname)), true)
+	}
+	return p.exec(desc, fmt.Sprintf(SQL_DropIndex, p.quoteIndexName(tablename, indexname)), true)
 }
-func (p *PgMeta) getColumnDefine(dataType datatable.ColumnType, maxSize int) string {
-	rev := ""
-	switch dataType {
-	case datatable.String:
-		if maxSize > 0 {
-			rev = fmt.Sprintf("character varying(%d)", maxSize)
-		} else {
-			rev = "text"
-		}
-	case datatable.Bool:
-		rev = "boolean"
-	case datatable.Int64:
-		rev = "bigint"
-	case datatable.Float64:
-		rev = "double precision"
-	case datatable.Time:
-		rev = "timestamp without time zone"
-	case datatable.Bytea:
-		rev = "bytea"
+func (p *PgMeta) getColumnDefine(dataType datatable.ColumnType, maxSize int, modifiers ...int) string {
+	return p.types().Define(dataType, maxSize, modifiers...)
+}
+
+// columnDefine return the catalog type of the column if present,
+// otherwise build it from the datatable type,the max size and the precision/scale
+func (p *PgMeta) columnDefine(column *Column) string {
+	if column.DBType != "" {
+		return column.DBType
+	}
+	return p.getColumnDefine(column.Type, column.MaxSize, columnModifiers(column)...)
+}
+
+// columnModifiers return the precision and scale of the column,empty if the precision not set
+func columnModifiers(column *Column) []int {
+	switch {
+	case column.Precision <= 0:
+		return nil
+	case column.Scale > 0:
+		return []int{column.Precision, column.Scale}
 	default:
-		panic(fmt.Errorf("the type %s invalid", dataType))
+		return []int{column.Precision}
 	}
-	return rev
+}
+
+// columnCreateDefine return the column type and the constraints used by the CREATE TABLE and ADD COLUMN
+func (p *PgMeta) columnCreateDefine(column *Column) string {
+	switch column.Identity {
+	case IdentitySerial:
+		switch column.DBType {
+		case "smallint":
+			return "smallserial"
+		case "integer":
+			return "serial"
+		default:
+			return "bigserial"
+		}
+	case IdentityAlways, IdentityByDefault:
+		return p.columnDefine(column) + " " + identityGenerated(column.Identity)
+	}
+	return p.columnDefine(column) + p.columnConstraint(column)
+}
+
+func identityGenerated(identity Identity) string {
+	if identity == IdentityAlways {
+		return "GENERATED ALWAYS AS IDENTITY"
+	}
+	return "GENERATED BY DEFAULT AS IDENTITY"
+}
+
+// typeChanged compare the exact catalog type only if the new column has it,
+// so the model with the datatable type not change an integer column to bigint.
+// the precision and scale are compared only if the new column has the precision
+func (p *PgMeta) typeChanged(oldColumn, newColumn *Column) bool {
+	if newColumn.DBType != "" {
+		return p.columnDefine(oldColumn) != newColumn.DBType
+	}
+	if newColumn.Precision > 0 && (oldColumn.Precision != newColumn.Precision || oldColumn.Scale != newColumn.Scale) {
+		return true
+	}
+	return oldColumn.Type != newColumn.Type || oldColumn.MaxSize != newColumn.MaxSize
 }
 func (p *PgMeta) StringExpress(value string) string {
 	var rev bytes.Buffer
@@ -116,131 +211,294 @@ func getDefault(t datatable.ColumnType) string {
 
 }
 func (p *PgMeta) AlterColumn(tablename string, oldColumn, newColumn *dbhelper.TableColumn) error {
-	if oldColumn.Name != newColumn.Name {
-		if _, err := p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s RENAME %s TO %s", tablename, oldColumn.Name, newColumn.Name)); err != nil {
+	return p.AlterTableColumn(tablename, NewColumn(oldColumn), NewColumn(newColumn))
+}
+
+// AlterTableColumn is the AlterColumn with the PostgreSQL column attributes,
+// the changes are applied in a transaction,except the online type change and the NOT NULL.
+// the NOT NULL is set after the transaction commit by the validated check constraint,
+// it can fail on its own and leave the other changes applied,the NULL rows are counted before any change
+// to avoid it,but the rows inserted meanwhile are not
+func (p *PgMeta) AlterTableColumn(tablename string, oldColumn, newColumn *Column) error {
+	if oldColumn.Identity != newColumn.Identity &&
+		(oldColumn.Identity == IdentitySerial || newColumn.Identity == IdentitySerial) {
+		return fmt.Errorf("the column %q change between the serial and the identity not supported", newColumn.Name)
+	}
+	//the identity column is NOT NULL,it is set before the identity is added
+	addIdentity := oldColumn.Identity == IdentityNone && newColumn.Identity != IdentityNone
+	if !oldColumn.NotNull && (newColumn.NotNull || addIdentity) && newColumn.NullFill == "" {
+		if err := p.checkNotNull(tablename, oldColumn, newColumn); err != nil {
 			return err
 		}
 	}
-	if oldColumn.Type != newColumn.Type || oldColumn.MaxSize != newColumn.MaxSize {
-		if _, err := p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", tablename, newColumn.Name, p.getColumnDefine(newColumn.Type, newColumn.MaxSize))); err != nil {
+	if p.OnlineTypeChange > 0 && p.typeChanged(oldColumn, newColumn) {
+		if err := p.checkTypeChange(tablename, oldColumn, newColumn); err != nil {
 			return err
 		}
+		column, err := p.changeTypeOnline(tablename, oldColumn, newColumn)
+		if err != nil {
+			return err
+		}
+		oldColumn = column
 	}
-	if oldColumn.NotNull != newColumn.NotNull {
-		if newColumn.NotNull {
-			if _, err := p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s", tablename, newColumn.Name, getDefault(newColumn.Type))); err != nil {
-				return err
+	tname := p.QuoteTableName(tablename)
+	colName := p.QuoteIdent(newColumn.Name)
+	batch := &ddlBatch{}
+	if oldColumn.Name != newColumn.Name {
+		batch.add(fmt.Sprintf("rename the column %q to %q", oldColumn.Name, newColumn.Name),
+			fmt.Sprintf(SQL_RenameColumn, tname, p.QuoteIdent(oldColumn.Name), colName))
+	}
+	oldDefault := oldColumn.Default
+	if p.typeChanged(oldColumn, newColumn) {
+		if err := p.checkTypeChange(tablename, oldColumn, newColumn); err != nil {
+			return err
+		}
+		//the old default may not be cast to the new type,it is dropped first and the new one is set after
+		if oldDefault != "" {
+			batch.add(fmt.Sprintf("drop the column %q default", newColumn.Name),
+				fmt.Sprintf(SQL_DropColumnDefault, tname, colName))
+			oldDefault = ""
+		}
+		batch.addDestructive(fmt.Sprintf("change the column %q type to %s", newColumn.Name, p.columnDefine(newColumn)),
+			fmt.Sprintf(SQL_AlterColumnType+" USING %v", tname, colName, p.columnDefine(newColumn), p.usingCast(colName, oldColumn, newColumn)))
+	}
+	if oldColumn.Identity != newColumn.Identity {
+		var sql string
+		switch {
+		case newColumn.Identity == IdentityNone:
+			sql = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP IDENTITY IF EXISTS", tname, colName)
+		case addIdentity:
+			if oldDefault != "" {
+				batch.add(fmt.Sprintf("drop the column %q default", newColumn.Name),
+					fmt.Sprintf(SQL_DropColumnDefault, tname, colName))
+				oldDefault = ""
 			}
-			if _, err := p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", tablename, newColumn.Name)); err != nil {
-				return err
+			if !oldColumn.NotNull {
+				if newColumn.NullFill != "" {
+					batch.add(fmt.Sprintf("fill the NULL values of the column %q", newColumn.Name),
+						fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NULL", tname, colName, newColumn.NullFill, colName))
+				}
+				batch.add(fmt.Sprintf("set the column %q not null", newColumn.Name),
+					fmt.Sprintf(SQL_SetColumnNotNull, tname, colName))
 			}
+			sql = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s ADD %s", tname, colName, identityGenerated(newColumn.Identity))
+		default:
+			sql = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET %s", tname, colName, strings.TrimSuffix(identityGenerated(newColumn.Identity), " AS IDENTITY"))
+		}
+		if newColumn.Identity == IdentityNone {
+			batch.addDestructive(fmt.Sprintf("drop the column %q identity", newColumn.Name), sql)
 		} else {
-			if _, err := p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", tablename, newColumn.Name)); err != nil {
-				return err
-			}
+			batch.add(fmt.Sprintf("change the column %q identity", newColumn.Name), sql)
+		}
+		//the new sequence start after the existing values,otherwise the next insert get the duplicate key
+		if addIdentity {
+			batch.add(fmt.Sprintf("restart the column %q identity", newColumn.Name),
+				fmt.Sprintf("SELECT setval(pg_get_serial_sequence(%s,%s),coalesce(max(%s),0)+1,false) FROM %s",
+					p.StringExpress(tname), p.StringExpress(newColumn.Name), colName, tname))
 		}
 	}
+	if oldDefault != newColumn.Default {
+		if newColumn.Default == "" {
+			batch.add(fmt.Sprintf("drop the column %q default", newColumn.Name),
+				fmt.Sprintf(SQL_DropColumnDefault, tname, colName))
+		} else {
+			batch.add(fmt.Sprintf("set the column %q default", newColumn.Name),
+				fmt.Sprintf(SQL_SetColumnDefault, tname, colName, newColumn.Default))
+		}
+	}
+	if oldColumn.NotNull && !newColumn.NotNull && newColumn.Identity == IdentityNone {
+		batch.add(fmt.Sprintf("drop the column %q not null", newColumn.Name),
+			fmt.Sprintf(SQL_DropColumnNotNull, tname, colName))
+	}
 	if !oldColumn.Desc.Equal(newColumn.Desc) {
 		if newColumn.Desc.IsEmpty() {
-			if _, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON COLUMN %s.%s IS NULL", tablename, newColumn.Name)); err != nil {
-				return err
-			}
+			batch.add(fmt.Sprintf("comment the column %q", newColumn.Name),
+				fmt.Sprintf("COMMENT ON COLUMN %s.%s IS NULL", tname, colName))
 		} else {
-			if _, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", tablename, newColumn.Name, p.StringExpress(newColumn.Desc.String()))); err != nil {
-				return err
-			}
+			batch.add(fmt.Sprintf("comment the column %q", newColumn.Name),
+				fmt.Sprintf(SQL_AlterColumnDesc, tname, colName, p.StringExpress(newColumn.Desc.String())))
 		}
 	}
+	if err := p.execBatch(batch, false); err != nil {
+		return err
+	}
+	//the not null run out of the batch,so the validation not hold the exclusive lock
+	if !oldColumn.NotNull && newColumn.NotNull && !addIdentity {
+		return p.setNotNull(tablename, newColumn)
+	}
 	return nil
 }
 func (p *PgMeta) AlterTableDesc(tablename string, desc dbhelper.DBDesc) error {
+	stepDesc := fmt.Sprintf("comment the table %q", tablename)
 	if desc.IsEmpty() {
-		_, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON TABLE %v IS NULL", tablename))
-		return err
-
+		return p.exec(stepDesc, fmt.Sprintf("COMMENT ON TABLE %v IS NULL", p.QuoteTableName(tablename)), false)
 	} else {
-		_, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON TABLE %v IS %s", tablename, p.StringExpress(desc.String())))
-		return err
+		return p.exec(stepDesc, fmt.Sprintf(SQL_AlterTableDesc, p.QuoteTableName(tablename), p.StringExpress(desc.String())), false)
 	}
 }
 func (p *PgMeta) AlterIndex(tablename, indexname string, oldIndex, newIndex *dbhelper.Index) error {
-	if err := p.DropIndex(tablename, indexname); err != nil {
+	indexes, err := p.GetIndexDefines(tablename)
+	if err != nil {
 		return err
 	}
-	if err := p.CreateIndex(tablename, indexname, newIndex.Columns, newIndex.Unique, newIndex.Desc); err != nil {
-		return err
+	newDefine := &IndexDefine{
+		Name:   indexname,
+		Unique: newIndex.Unique,
+		Keys:   p.indexKeys(newIndex.Columns),
+		Desc:   newIndex.Desc,
 	}
-	return nil
+	for _, v := range indexes {
+		if v.Name != indexname {
+			continue
+		}
+		//keep the method,expressions,include and predicate that dbhelper.Index not modeled
+		if strings.Join(indexColumns(v.Keys), ",") == strings.Join(newIndex.Columns, ",") {
+			newDefine.Keys = v.Keys
+		}
+		newDefine.Method = v.Method
+		newDefine.Include = v.Include
+		newDefine.Where = v.Where
+		return p.AlterIndexDefine(tablename, v, newDefine)
+	}
+	return p.CreateIndexDefine(tablename, newDefine)
 }
 func (p *PgMeta) CreateIndex(tableName, indexName string, columns []string, unique bool, desc dbhelper.DBDesc) error {
-	uniqueStr := ""
-	if unique {
-		uniqueStr = "UNIQUE"
-	}
-	if _, err := p.DBHelper.Exec(fmt.Sprintf("CREATE %sINDEX %s ON %s(%s)", uniqueStr, indexName, tableName, strings.Join(columns, ","))); err != nil {
-		return err
-	}
-	if desc.IsEmpty() {
-		_, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON INDEX %s IS NULL", indexName))
-		return err
-	} else {
-		_, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON INDEX %s IS %s", indexName, p.StringExpress(desc.String())))
-		return err
-	}
+	return p.CreateIndexDefine(tableName, &IndexDefine{
+		Name:   indexName,
+		Unique: unique,
+		Keys:   p.indexKeys(columns),
+		Desc:   desc,
+	})
 }
 func (p *PgMeta) CreateTable(table *dbhelper.DataTable) error {
-	creates := make([]string, table.ColumnCount())
+	return p.CreateTableDefine(NewTable(table))
+}
+
+// CreateTableDefine is the CreateTable with the PostgreSQL column attributes,
+// the table and its comments are created in a transaction
+func (p *PgMeta) CreateTableDefine(table *Table) error {
+	return p.createTableDefine(table, true)
+}
+
+// createTableDefine create the table,the steps are run at once without the Plan unless planned
+func (p *PgMeta) createTableDefine(table *Table, planned bool) error {
+	tname := p.QuoteTableName(table.Name)
+	creates := make([]string, len(table.Columns))
 	for i, c := range table.Columns {
-		nullStr := ""
-		if c.NotNull {
-			nullStr = fmt.Sprintf(" NOT NULL DEFAULT %s", getDefault(c.DataType))
-		}
-		creates[i] = fmt.Sprintf("%s %s %s", c.Name, p.getColumnDefine(c.DataType, c.MaxSize), nullStr)
+		creates[i] = fmt.Sprintf("%s %s", p.QuoteIdent(c.Name), p.columnCreateDefine(c))
 	}
-	if table.HasPrimaryKey() {
-		creates = append(creates, fmt.Sprintf("PRIMARY KEY(%s)", strings.Join(table.PK, ",")))
+	if len(table.PK) > 0 {
+		creates = append(creates, fmt.Sprintf("PRIMARY KEY(%s)", strings.Join(p.QuoteIdents(table.PK), ",")))
 	}
+	batch := &ddlBatch{}
 	if table.Temporary {
-		_, err := p.DBHelper.Exec(fmt.Sprintf("CREATE TEMPORARY TABLE %s(\n%s\n) ON COMMIT DROP", table.TableName, strings.Join(creates, ",")))
-		return err
+		batch.add(fmt.Sprintf("create the temporary table %q", table.Name),
+			fmt.Sprintf("CREATE TEMPORARY TABLE %s(\n%s\n) ON COMMIT DROP", tname, strings.Join(creates, ",")))
 	} else {
-		_, err := p.DBHelper.Exec(fmt.Sprintf("CREATE TABLE %s(\n%s\n)", table.TableName, strings.Join(creates, ",")))
-		return err
+		batch.add(fmt.Sprintf("create the table %q", table.Name),
+			fmt.Sprintf("CREATE TABLE %s(\n%s\n)", tname, strings.Join(creates, ",")))
 	}
 	for _, c := range table.Columns {
 		if !c.Desc.IsEmpty() {
-			if _, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", table.TableName, c.Name, p.StringExpress(c.Desc.String()))); err != nil {
-				return err
-			}
+			batch.add(fmt.Sprintf("comment the column %q", c.Name),
+				fmt.Sprintf(SQL_AlterColumnDesc, tname, p.QuoteIdent(c.Name), p.StringExpress(c.Desc.String())))
 		}
 	}
 	if !table.Desc.IsEmpty() {
-		p.AlterTableDesc(table.TableName, table.Desc)
+		batch.add(fmt.Sprintf("comment the table %q", table.Name),
+			fmt.Sprintf(SQL_AlterTableDesc, tname, p.StringExpress(table.Desc.String())))
 	}
-	return nil
+	if !planned {
+		return p.runSteps(batch.steps, table.Temporary)
+	}
+	return p.execBatch(batch, table.Temporary)
 }
-func (p *PgMeta) AddColumn(tablename string, column *dbhelper.TableColumn) error {
-	nullStr := ""
+
+// columnConstraint return the NOT NULL and DEFAULT clause of the column,
+// the default is written only if the column has it
+func (p *PgMeta) columnConstraint(column *Column) string {
+	rev := ""
 	if column.NotNull {
-		nullStr = " NOT NULL DEFAULT " + getDefault(column.Type)
+		rev = " NOT NULL"
 	}
-	if _, err := p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s%s", tablename, column.Name, p.getColumnDefine(column.Type, column.MaxSize), nullStr)); err != nil {
-		return err
+	if column.Default != "" {
+		rev += " DEFAULT " + column.Default
+	}
+	return rev
+}
+func (p *PgMeta) AddColumn(tablename string, column *dbhelper.TableColumn) error {
+	return p.AddTableColumn(tablename, NewColumn(column))
+}
 
+// AddTableColumn is the AddColumn with the PostgreSQL column attributes.
+// the not null column without default fill the existing rows by the NullFill,
+// or the zero value of the type if the NullFill is empty,the fill is not left as the default
+func (p *PgMeta) AddTableColumn(tablename string, column *Column) error {
+	tname := p.QuoteTableName(tablename)
+	colName := p.QuoteIdent(column.Name)
+	batch := &ddlBatch{}
+	if column.NotNull && column.Default == "" && column.Identity == IdentityNone {
+		fill := column.NullFill
+		if fill == "" {
+			fill = getDefault(column.Type)
+		}
+		batch.add(fmt.Sprintf("add the column %q", column.Name),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s DEFAULT %s", tname, colName, p.columnCreateDefine(column), fill))
+		batch.add(fmt.Sprintf("drop the column %q fill default", column.Name),
+			fmt.Sprintf(SQL_DropColumnDefault, tname, colName))
+	} else {
+		batch.add(fmt.Sprintf("add the column %q", column.Name),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tname, colName, p.columnCreateDefine(column)))
 	}
 	if !column.Desc.IsEmpty() {
-		if _, err := p.DBHelper.Exec(fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", tablename, column.Name, p.StringExpress(column.Desc.String()))); err != nil {
-			return err
-		}
+		batch.add(fmt.Sprintf("comment the column %q", column.Name),
+			fmt.Sprintf(SQL_AlterColumnDesc, tname, colName, p.StringExpress(column.Desc.String())))
 	}
-	return nil
+	return p.execBatch(batch, false)
 }
 func (p *PgMeta) AddPrimaryKey(tablename string, pks []string) error {
-	_, err := p.DBHelper.Exec(fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY(%s)", tablename, strings.Join(pks, ",")))
-	return err
+	return p.exec(fmt.Sprintf("add the primary key of the table %q", tablename),
+		fmt.Sprintf(SQL_CreatePrimaryKey, p.QuoteTableName(tablename), strings.Join(p.QuoteIdents(pks), ",")), false)
+}
+
+// InsertReturning insert the row and return the values of the returning columns,
+// used to read back the keys generated by the identity or serial columns
+func (p *PgMeta) InsertReturning(tablename string, row map[string]interface{}, returning ...string) (map[string]interface{}, error) {
+	if len(returning) == 0 {
+		return nil, fmt.Errorf("the returning columns is empty")
+	}
+	names := make([]string, 0, len(row))
+	for k := range row {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	params := make([]string, len(names))
+	args := make([]interface{}, len(names))
+	for i, v := range names {
+		params[i] = p.ParamPlaceholder(i + 1)
+		args[i] = row[v]
+	}
+	var strSql string
+	if len(names) == 0 {
+		strSql = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES RETURNING %s",
+			p.QuoteTableName(tablename), strings.Join(p.QuoteIdents(returning), ","))
+	} else {
+		strSql = fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s) RETURNING %s",
+			p.QuoteTableName(tablename), strings.Join(p.QuoteIdents(names), ","),
+			strings.Join(params, ","), strings.Join(p.QuoteIdents(returning), ","))
+	}
+	table, err := p.DBHelper.GetData(strSql, args...)
+	if err != nil {
+		return nil, err
+	}
+	//a BEFORE trigger or a rule may skip the insert
+	if table.RowCount() == 0 {
+		return nil, fmt.Errorf("insert into the table %q return no row", tablename)
+	}
+	return table.Row(0), nil
 }
 func (p *PgMeta) GetTableDesc(tablename string) (dbhelper.DBDesc, error) {
-	rev, err := p.DBHelper.QueryOne("select obj_description($1::regclass,'pg_class')", tablename)
+	rev, err := p.DBHelper.QueryOne("select obj_description($1::regclass,'pg_class')", p.QuoteTableName(tablename))
 	if err != nil {
 		return nil, err
 	}
@@ -261,119 +519,88 @@ func (p *PgMeta) GetTableDesc(tablename string) (dbhelper.DBDesc, error) {
 	}
 }
 func (p *PgMeta) GetIndexes(tablename string) ([]*dbhelper.TableIndex, error) {
-	table, err := p.DBHelper.GetData(`
-		select
-		    i.relname as index_name,
-			max(CAST(ix.indisunique AS integer)) as unique,
-		    array_to_string(array_agg(a.attname), ',') as columns,
-			obj_description(max(i.oid)) as index_desc
-		from
-		    pg_class t,
-		    pg_class i,
-		    pg_index ix,
-		    pg_attribute a
-		where
-		    t.oid = ix.indrelid
-		    and i.oid = ix.indexrelid
-		    and a.attrelid = t.oid
-		    and a.attnum = ANY(ix.indkey)
-		    and t.relkind = 'r'
-		    and t.relname = $1
-			and ix.indisprimary = false
-		group by
-		    t.relname,
-		    i.relname
-		order by
-		    t.relname,
-		    i.relname`, tablename)
+	indexes, err := p.GetIndexDefines(tablename)
 	if err != nil {
 		return nil, err
 	}
-	rev := make([]*dbhelper.TableIndex, table.RowCount())
-	for i := 0; i < table.RowCount(); i++ {
-		row := table.Row(i)
+	rev := make([]*dbhelper.TableIndex, len(indexes))
+	for i, v := range indexes {
 		rev[i] = &dbhelper.TableIndex{}
-		rev[i].Name = row["index_name"].(string)
-		rev[i].Columns = strings.Split(row["columns"].(string), ",")
-		if row["unique"].(int64) == 0 {
-			rev[i].Unique = false
-		} else {
-			rev[i].Unique = true
-		}
-		rev[i].Desc = dbhelper.DBDesc{}
-		if row["index_desc"] != nil {
-			rev[i].Desc.Parse(row["index_desc"].(string))
-		}
+		rev[i].Name = v.Name
+		rev[i].Columns = indexColumns(v.Keys)
+		rev[i].Unique = v.Unique
+		rev[i].Desc = v.Desc
 	}
 	return rev, nil
 }
 func (p *PgMeta) GetColumns(tablename string) ([]*dbhelper.TableColumn, error) {
-	table, err := p.DBHelper.GetData(`
-		SELECT
-		  a.attname as column_name,
-		  a.attnotnull as notnull,
-		  pg_catalog.format_type(a.atttypid, a.atttypmod) AS data_type,
-		  col_description(b.oid,a.attnum) as column_desc
-		FROM
-		  pg_catalog.pg_attribute a join
-		  (SELECT  c.oid
-		   FROM    pg_catalog.pg_class c LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
-		   WHERE c.relname =$1 AND (n.nspname) = current_schema
-		  ) b on a.attrelid = b.oid left join
-		  pg_catalog.pg_attrdef d ON (a.attrelid, a.attnum) = (d.adrelid,  d.adnum)
-		WHERE
+	columns, err := p.GetTableColumns(tablename)
+	if err != nil {
+		return nil, err
+	}
+	return TableColumns(columns), nil
+}
 
-		  a.attnum > 0 AND
-		  NOT a.attisdropped
-		ORDER BY
-		  a.attnum`, tablename)
+// GetTableColumns is the GetColumns with the PostgreSQL column attributes
+func (p *PgMeta) GetTableColumns(tablename string) ([]*Column, error) {
+	strSql, err := p.identitySQL(SQL_SchemaTableColumns)
+	if err != nil {
+		return nil, err
+	}
+	schema, tname := splitTableName(tablename)
+	table, err := p.DBHelper.GetData(strSql, schema, tname)
 	if err != nil {
 		return nil, err
 	}
-	rev := make([]*dbhelper.TableColumn, table.RowCount())
+	rev := make([]*Column, table.RowCount())
 	for i := 0; i < table.RowCount(); i++ {
-		row := table.Row(i)
-		rev[i] = &dbhelper.TableColumn{}
-		rev[i].Name = row["column_name"].(string)
-		t := row["data_type"].(string)
-		switch {
-		case t == "text":
-			rev[i].Type = datatable.String
-			rev[i].MaxSize = 0
-		case t == "boolean":
-			rev[i].Type = datatable.Bool
-		case t == "bigint":
-			rev[i].Type = datatable.Int64
-		case t == "double precision":
-			rev[i].Type = datatable.Float64
-		case regVarchar.MatchString(t):
-			rev[i].Type = datatable.String
-			var err error
-
-			if rev[i].MaxSize, err = strconv.Atoi(regVarchar.FindStringSubmatch(t)[1]); err != nil {
-				return nil, err
-			}
-		case t == "timestamp without time zone" ||
-			t == "timestamp with time zone" ||
-			t == "date":
-			rev[i].Type = datatable.Time
-		case t == "bytea":
-			rev[i].Type = datatable.Bytea
+		if rev[i], err = p.columnFromRow(table.Row(i)); err != nil {
+			return nil, err
+		}
+	}
+	return rev, nil
+}
 
-		default:
-			return nil, fmt.Errorf("the column %q type %s invalid", row["column_name"], row["data_type"])
+// columnFromRow build the column from the row of the catalog query,
+// the row may be decoded from the JSON of the GetSchema
+func (p *PgMeta) columnFromRow(row map[string]interface{}) (*Column, error) {
+	rev := NewColumn(&dbhelper.TableColumn{})
+	rev.Name = row["column_name"].(string)
+	rev.DBType = row["data_type"].(string)
+	var modifiers []int
+	var err error
+	if rev.Type, rev.MaxSize, modifiers, err = p.types().Parse(rev.DBType); err != nil {
+		return nil, fmt.Errorf("the column %q type %s invalid:%s", rev.Name, rev.DBType, err)
+	}
+	if rev.MaxSize == 0 && len(modifiers) > 0 {
+		rev.Precision = modifiers[0]
+		if len(modifiers) > 1 {
+			rev.Scale = modifiers[1]
 		}
-		if row["notnull"].(bool) {
-			rev[i].NotNull = true
+	}
+	if row["column_default"] != nil {
+		rev.Default = row["column_default"].(string)
+	}
+	if row["column_sequence"] != nil {
+		rev.Sequence = row["column_sequence"].(string)
+		if identity := row["column_identity"].(string); identity != "" {
+			rev.Identity = Identity(identity)
 		} else {
-			rev[i].NotNull = false
-		}
-		if row["column_desc"] != nil && row["column_desc"].(string) != "" {
-			desc := dbhelper.DBDesc{}
-			desc.Parse(row["column_desc"].(string))
-			rev[i].Desc = desc
+			//the serial column's default is the nextval of the owned sequence
+			rev.Identity = IdentitySerial
+			rev.Default = ""
 		}
 	}
+	if row["notnull"].(bool) {
+		rev.NotNull = true
+	} else {
+		rev.NotNull = false
+	}
+	if row["column_desc"] != nil && row["column_desc"].(string) != "" {
+		desc := dbhelper.DBDesc{}
+		desc.Parse(row["column_desc"].(string))
+		rev.Desc = desc
+	}
 	return rev, nil
 }
 func (p *PgMeta) getPrimaryKeyConstraintName(tablename string) (string, error) {
@@ -387,7 +614,7 @@ func (p *PgMeta) getPrimaryKeyConstraintName(tablename string) (string, error) {
 		  pg_attribute.attrelid = pg_class.oid AND
 		  pg_index.indexrelid = idx.oid and
 		  pg_attribute.attnum = any(pg_index.indkey) AND
-		  indisprimary`, tablename)
+		  indisprimary`, p.QuoteTableName(tablename))
 	if err != nil {
 		return "", err
 	}
@@ -404,105 +631,12 @@ func (p *PgMeta) GetPrimaryKeys(tablename string) ([]string, error) {
 		  pg_attribute.attrelid = pg_class.oid AND
 		  pg_index.indexrelid = idx.oid and
 		  pg_attribute.attnum = any(pg_index.indkey) AND
-		  indisprimary`, tablename)
+		  indisprimary`, p.QuoteTableName(tablename))
 	if err != nil {
 		return nil, err
 	}
 	return strings.Split(string(pks.([]byte)), ","), nil
 }
-func (p *PgMeta) Merge(dest, source string, colNames []string, pkColumns []string, autoUpdate, autoRemove bool, sqlWhere string) error {
-	if len(pkColumns) == 0 {
-		return fmt.Errorf("the primary keys is empty")
-	}
-	if len(colNames) == 0 {
-		return fmt.Errorf("the columns is empty")
-	}
-	tmp := template.New("sql")
-	tmp.Funcs(template.FuncMap{
-		"Join": func(value []string, sep, prefix string) string {
-			if prefix == "" {
-				return strings.Join(value, sep)
-			} else {
-				rev := make([]string, len(value))
-				for i, v := range value {
-					rev[i] = prefix + v
-				}
-				return strings.Join(rev, sep)
-			}
-		},
-		"First": func(value []string) string {
-			return value[0]
-		},
-	})
-	tmp, err := tmp.Parse(`
-WITH updated as (
-	{{if (and .autoUpdate (gt (len .updateColumns) 0))}}
-        UPDATE {{.destTable}} dest SET
-            ({{Join .updateColumns "," ""}}) = ({{Join .updateColumns "," "src."}})
-        FROM {{.sourceTable}} src
-        WHERE
-		{{range $idx,$colName :=.pkColumns}}
-            {{if gt $idx 0}}AND {{end}}dest.{{$colName}}=src.{{$colName}}
-		{{end}}
-        RETURNING {{Join .pkColumns "," "src."}}
-	{{else}}
-        SELECT {{Join .pkColumns "," "src."}} FROM {{.destTable}} dest JOIN {{.sourceTable}} src USING({{Join .pkColumns "," ""}})
-	{{end}}
-    )
-	{{if .autoRemove}},
-    deleted as (
-        DELETE FROM {{.destTable}} dest WHERE{{if ne .sqlWhere ""}}
-            ({{.sqlWhere}}) AND {{end}}
-            NOT EXISTS(
-                SELECT 1 FROM {{.sourceTable}} src WHERE{{range $idx,$colName :=.pkColumns}}
-                    {{if gt $idx 0}}AND {{end}}dest.{{$colName}}=src.{{$colName}}{{end}}
-            )
-    )
-	{{end}}
-INSERT INTO {{.destTable}}(
-    {{Join .colNames ",\n    " ""}}
-)
-SELECT
-    {{Join .colNames ",\n    " "src."}}
-FROM
-    {{.sourceTable}} src LEFT JOIN updated USING({{Join .pkColumns "," ""}})
-WHERE updated.{{First .pkColumns}} IS NULL`)
-	if err != nil {
-		return err
-	}
-	var b bytes.Buffer
-	//primary key not update
-	updateColumns := []string{}
-
-	for _, v := range colNames {
-		bFound := false
-		for _, pv := range pkColumns {
-			if v == pv {
-				bFound = true
-				break
-			}
-		}
-		if !bFound {
-			updateColumns = append(updateColumns, v)
-		}
-	}
-
-	param := map[string]interface{}{
-		"destTable":     dest,
-		"sourceTable":   source,
-		"updateColumns": updateColumns,
-		"colNames":      colNames,
-		"autoUpdate":    autoUpdate,
-		"autoRemove":    autoRemove,
-		"sqlWhere":      sqlWhere,
-		"pkColumns":     pkColumns,
-	}
-	if err := tmp.Execute(&b, param); err != nil {
-		return err
-	}
-	_, err = p.DBHelper.Exec(b.String())
-	return err
-}
 func (p *PgMeta) StringCat(values ...string) string {
 	return strings.Join(values, "||")
 }
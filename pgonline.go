@@ -0,0 +1,283 @@
+package pghelper
+
+import (
+	"fmt"
+	"github.com/linlexing/dbhelper"
+	"strings"
+)
+
+// primaryKeyColumns return the primary key columns of the table,empty if the table has no primary key
+func (p *PgMeta) primaryKeyColumns(tablename string) ([]string, error) {
+	table, err := p.DBHelper.GetData(SQL_TablePrimaryKeys, p.QuoteTableName(tablename))
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]string, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		rev[i] = table.Row(i)["columnname"].(string)
+	}
+	return rev, nil
+}
+
+// changeTypeOnline change the column to the new type without rewriting the table under the exclusive lock:
+// add a shadow column of the new type,keep it in sync by a trigger,backfill it in the primary key order
+// by the batches of OnlineTypeChange rows,then drop the old column and rename the shadow one in a transaction.
+// the column used by the indexes or constraints is refused,because they would be dropped with the old column.
+// on the failure the trigger is dropped and the shadow column is kept,the retry reuse it
+// and only update the rows that are not converted yet.
+// the default is carried to the shadow column before the swap,the new one if any,else the old one cast to the new type.
+// the NOT NULL and the comment are left to the caller.
+// in the dry-run mode the backfill is recorded as one UPDATE of the whole table.
+// return the column after the change,it has the new type,the carried default and is nullable
+func (p *PgMeta) changeTypeOnline(tablename string, oldColumn, newColumn *Column) (*Column, error) {
+	columns, err := p.GetTableColumns(tablename)
+	if err != nil {
+		return nil, err
+	}
+	var live *Column
+	for _, v := range columns {
+		if v.Name == oldColumn.Name {
+			live = v
+		}
+	}
+	if live == nil {
+		return nil, fmt.Errorf("the column %q of the table %q not exists", oldColumn.Name, tablename)
+	}
+	//the model of the caller may have no identity,the live column tell the identity and the serial,
+	//the owned sequence of the serial would be dropped with the old column
+	if live.Identity != IdentityNone || oldColumn.Identity != IdentityNone {
+		return nil, fmt.Errorf("the identity or serial column %q can not change type online", oldColumn.Name)
+	}
+	pks, err := p.primaryKeyColumns(tablename)
+	if err != nil {
+		return nil, err
+	}
+	if len(pks) == 0 {
+		return nil, fmt.Errorf("the table %q has no primary key,can not change the column %q type online", tablename, oldColumn.Name)
+	}
+	dependents, err := p.columnDependents(tablename, oldColumn.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(dependents) > 0 {
+		return nil, fmt.Errorf("the column %q is used by %s,can not change type online", oldColumn.Name, strings.Join(dependents, ","))
+	}
+	tname := p.QuoteTableName(tablename)
+	_, table := splitTableName(tablename)
+	colName := p.QuoteIdent(oldColumn.Name)
+	shadowColumn := shadowName(oldColumn.Name, "_pghelper_new")
+	shadow := p.QuoteIdent(shadowColumn)
+	trigger := p.QuoteIdent(shadowName(table+"_"+oldColumn.Name, "_pghelper_sync"))
+	//the function live in the schema of the table like the index
+	function := p.quoteIndexName(tablename, shadowName(table+"_"+oldColumn.Name, "_pghelper_sync"))
+
+	prepare := &ddlBatch{}
+	var leftover *Column
+	for _, v := range columns {
+		if v.Name == shadowColumn {
+			leftover = v
+		}
+	}
+	//the leftover shadow column of the failed change is reused,unless it has another type
+	if leftover != nil && p.typeChanged(leftover, newColumn) {
+		prepare.addDestructive(fmt.Sprintf("drop the leftover shadow column of %q", oldColumn.Name),
+			fmt.Sprintf(SQL_DropColumn, tname, shadow))
+		leftover = nil
+	}
+	if leftover == nil {
+		prepare.add(fmt.Sprintf("add the shadow column of %q", oldColumn.Name),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tname, shadow, p.columnDefine(newColumn)))
+	}
+	prepare.add(fmt.Sprintf("create the sync function of %q", oldColumn.Name),
+		fmt.Sprintf("CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$\nBEGIN\n  NEW.%s := %s;\n  RETURN NEW;\nEND\n$$ LANGUAGE plpgsql",
+			function, shadow, p.usingCast("NEW."+colName, oldColumn, newColumn)))
+	prepare.add(fmt.Sprintf("drop the leftover sync trigger of %q", oldColumn.Name),
+		fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", trigger, tname))
+	prepare.add(fmt.Sprintf("create the sync trigger of %q", oldColumn.Name),
+		fmt.Sprintf("CREATE TRIGGER %s BEFORE INSERT OR UPDATE ON %s FOR EACH ROW EXECUTE PROCEDURE %s()", trigger, tname, function))
+	if err := p.execBatch(prepare, false); err != nil {
+		return nil, err
+	}
+	//the trigger not left behind on the failure,the shadow column is kept for the retry
+	cleanup := []*PlanStep{
+		{Desc: fmt.Sprintf("drop the sync trigger of %q", oldColumn.Name),
+			SQL: fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", trigger, tname)},
+		{Desc: fmt.Sprintf("drop the sync function of %q", oldColumn.Name),
+			SQL: fmt.Sprintf("DROP FUNCTION IF EXISTS %s()", function)},
+	}
+
+	//the SQL show the backfill as one UPDATE,it is run by the batches of the rows
+	backfill := &ddlBatch{cleanup: cleanup}
+	backfill.steps = append(backfill.steps, &PlanStep{
+		Desc: fmt.Sprintf("backfill the shadow column of %q", oldColumn.Name),
+		SQL:  fmt.Sprintf("UPDATE %s SET %s = %s", tname, shadow, p.usingCast(colName, oldColumn, newColumn)),
+		Backfill: &Backfill{
+			Table:  tname,
+			Keys:   pks,
+			Shadow: shadow,
+			Cast:   p.usingCast("dest."+colName, oldColumn, newColumn),
+			Size:   p.OnlineTypeChange,
+		},
+	})
+	if err := p.execBatch(backfill, false); err != nil {
+		return nil, err
+	}
+	rev := onlineColumn(oldColumn, newColumn)
+	rev.Default = newColumn.Default
+	if rev.Default == "" && live.Default != "" {
+		rev.Default = p.castExpress("("+live.Default+")", live, newColumn)
+	}
+
+	swap := &ddlBatch{cleanup: cleanup}
+	swap.add(fmt.Sprintf("drop the sync trigger of %q", oldColumn.Name),
+		fmt.Sprintf("DROP TRIGGER %s ON %s", trigger, tname))
+	swap.add(fmt.Sprintf("drop the sync function of %q", oldColumn.Name),
+		fmt.Sprintf("DROP FUNCTION %s()", function))
+	//the rows inserted after the swap get the default
+	if rev.Default != "" {
+		swap.add(fmt.Sprintf("set the shadow column of %q default", oldColumn.Name),
+			fmt.Sprintf(SQL_SetColumnDefault, tname, shadow, rev.Default))
+	}
+	swap.addDestructive(fmt.Sprintf("drop the old column %q", oldColumn.Name),
+		fmt.Sprintf(SQL_DropColumn, tname, colName))
+	swap.add(fmt.Sprintf("rename the shadow column to %q", oldColumn.Name),
+		fmt.Sprintf(SQL_RenameColumn, tname, shadow, colName))
+	if err := p.execBatch(swap, false); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// columnDependents return the indexes and constraints that use the column,
+// include the primary key and the expression index
+func (p *PgMeta) columnDependents(tablename, columnname string) ([]string, error) {
+	table, err := p.DBHelper.GetData(SQL_ColumnDependents, p.QuoteTableName(tablename), columnname)
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]string, table.RowCount())
+	for i := 0; i < table.RowCount(); i++ {
+		rev[i] = table.Row(i)["name"].(string)
+	}
+	return rev, nil
+}
+
+// backfillShadow set the shadow column in the primary key order,a statement per batch of batchSize rows,
+// each statement lock only the rows of its batch.
+// the rows already converted by the failed change are not updated again,
+// they are compared as the text because some types have no equality operator
+func (p *PgMeta) backfillShadow(tname string, pks []string, shadow, cast string, batchSize int) error {
+	keys := strings.Join(p.QuoteIdents(pks), ",")
+	joins := make([]string, len(pks))
+	descKeys := make([]string, len(pks))
+	for i, v := range p.QuoteIdents(pks) {
+		joins[i] = fmt.Sprintf("dest.%s = b.%s", v, v)
+		descKeys[i] = v + " DESC"
+	}
+	var last map[string]interface{}
+	for {
+		where := ""
+		args := []interface{}{}
+		if last != nil {
+			params := make([]string, len(pks))
+			for i, v := range pks {
+				params[i] = p.ParamPlaceholder(i + 1)
+				args = append(args, last[v])
+			}
+			where = fmt.Sprintf("WHERE (%s) > (%s)", keys, strings.Join(params, ","))
+		}
+		table, err := p.DBHelper.GetData(fmt.Sprintf(`
+			WITH b AS (
+			  SELECT %s FROM %s %s ORDER BY %s LIMIT %d
+			), u AS (
+			  UPDATE %s dest SET %s = %s FROM b WHERE %s AND dest.%s::text IS DISTINCT FROM (%s)::text
+			)
+			SELECT %s FROM b ORDER BY %s LIMIT 1`,
+			keys, tname, where, keys, batchSize,
+			tname, shadow, cast, strings.Join(joins, " AND "), shadow, cast,
+			keys, strings.Join(descKeys, ",")), args...)
+		if err != nil {
+			return err
+		}
+		if table.RowCount() == 0 {
+			return nil
+		}
+		last = table.Row(0)
+	}
+}
+
+// onlineColumn return the column after changeTypeOnline,it has the new type and is nullable
+func onlineColumn(oldColumn, newColumn *Column) *Column {
+	rev := NewColumn(&dbhelper.TableColumn{
+		Name:    oldColumn.Name,
+		Type:    newColumn.Type,
+		MaxSize: newColumn.MaxSize,
+		Desc:    dbhelper.DBDesc{},
+	})
+	rev.DBType = newColumn.DBType
+	rev.Precision = newColumn.Precision
+	rev.Scale = newColumn.Scale
+	return rev
+}
+
+// checkNotNull count the NULL rows of the column that change to NOT NULL without the NullFill,
+// include the empty strings converted to NULL by the type change.
+// it run before any change,so the column is not half altered by the NULL rows
+func (p *PgMeta) checkNotNull(tablename string, oldColumn, newColumn *Column) error {
+	colName := p.QuoteIdent(oldColumn.Name)
+	cond := colName + " IS NULL"
+	if p.typeChanged(oldColumn, newColumn) && castEmptyToNull(oldColumn, newColumn) {
+		cond = fmt.Sprintf("%s OR trim(%s) = ''", cond, colName)
+	}
+	v, err := p.DBHelper.QueryOne(fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", p.QuoteTableName(tablename), cond))
+	if err != nil {
+		return err
+	}
+	count, err := valueInt64(v)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("the column %q has %d NULL rows,set the NullFill to change it to not null", newColumn.Name, count)
+	}
+	return nil
+}
+
+// setNotNull change the column to NOT NULL without the long exclusive lock:
+// fill the NULL values by the NullFill,add a CHECK (col IS NOT NULL) NOT VALID and validate it,
+// then SET NOT NULL that use the validated check instead of scanning the table(PostgreSQL 12+),
+// and drop the check.no default is left behind
+func (p *PgMeta) setNotNull(tablename string, column *Column) error {
+	tname := p.QuoteTableName(tablename)
+	_, table := splitTableName(tablename)
+	colName := p.QuoteIdent(column.Name)
+	if column.NullFill != "" {
+		if err := p.exec(fmt.Sprintf("fill the NULL values of the column %q", column.Name),
+			fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NULL", tname, colName, column.NullFill, colName), false); err != nil {
+			return err
+		}
+	}
+	check := &CheckConstraint{
+		Name:       shadowName(table+"_"+column.Name, "_not_null"),
+		Expression: colName + " IS NOT NULL",
+		NotValid:   true,
+	}
+	if err := p.AddCheckConstraint(tablename, check); err != nil {
+		return err
+	}
+	//the NOT VALID check is not left behind on the failure
+	validate := &ddlBatch{}
+	validate.add(fmt.Sprintf("validate the constraint %q of the table %q", check.Name, tablename),
+		fmt.Sprintf(SQL_ValidateConstraint, tname, p.QuoteIdent(check.Name)))
+	validate.addCleanup(fmt.Sprintf("drop the not null check of the column %q", column.Name),
+		fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", tname, p.QuoteIdent(check.Name)))
+	if err := p.execBatch(validate, false); err != nil {
+		return err
+	}
+	batch := &ddlBatch{cleanup: validate.cleanup}
+	batch.add(fmt.Sprintf("set the column %q not null", column.Name),
+		fmt.Sprintf(SQL_SetColumnNotNull, tname, colName))
+	batch.add(fmt.Sprintf("drop the not null check of the column %q", column.Name),
+		fmt.Sprintf(SQL_DropConstraint, tname, p.QuoteIdent(check.Name)))
+	return p.execBatch(batch, false)
+}
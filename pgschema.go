@@ -0,0 +1,115 @@
+package pghelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/linlexing/dbhelper"
+)
+
+// Schema is the snapshot of the tables of a schema,
+// it has only the exported fields,so it can be saved as the JSON or YAML and loaded back
+type Schema struct {
+	Name   string
+	Desc   dbhelper.DBDesc
+	Tables []*SchemaTable
+}
+
+// SchemaTable is the table of the Schema with its indexes and constraints.
+// the table name is not qualified,the RefTable of the foreign key is qualified
+// only when it is not in the schema of the snapshot
+type SchemaTable struct {
+	Table
+	Indexes     []*IndexDefine
+	ForeignKeys []*ForeignKey
+	Checks      []*CheckConstraint
+	Uniques     []*UniqueConstraint
+}
+
+// Table return the table of the name,nil if not found
+func (s *Schema) Table(name string) *SchemaTable {
+	for _, v := range s.Tables {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// GetSchema return the snapshot of all the tables of the schema by one catalog query,
+// empty schema means the current schema.the query needs PostgreSQL 9.4 or later
+func (p *PgMeta) GetSchema(schema string) (*Schema, error) {
+	strSql, err := p.identitySQL(SQL_GetSchema)
+	if err != nil {
+		return nil, err
+	}
+	table, err := p.DBHelper.GetData(strSql, schema)
+	if err != nil {
+		return nil, err
+	}
+	if table.RowCount() == 0 {
+		return nil, fmt.Errorf("the schema %q not exists", schema)
+	}
+	//the catalog rows are aggregated as the JSON,the keys are same as the per-table queries
+	var snapshot struct {
+		Name   string
+		Desc   *string
+		Tables []struct {
+			Name        string
+			Desc        *string
+			Columns     []map[string]interface{}
+			PK          []string
+			Indexes     []map[string]interface{}
+			Constraints []map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(valueString(table.Row(0)["schema"])), &snapshot); err != nil {
+		return nil, fmt.Errorf("decode the schema %q fail:%s", schema, err)
+	}
+	rev := &Schema{
+		Name:   snapshot.Name,
+		Desc:   dbhelper.DBDesc{},
+		Tables: make([]*SchemaTable, len(snapshot.Tables)),
+	}
+	if snapshot.Desc != nil {
+		rev.Desc.Parse(*snapshot.Desc)
+	}
+	for i, t := range snapshot.Tables {
+		st := &SchemaTable{
+			Table: Table{
+				Name:    t.Name,
+				Columns: make([]*Column, len(t.Columns)),
+				PK:      t.PK,
+				Desc:    dbhelper.DBDesc{},
+			},
+			Indexes:     make([]*IndexDefine, len(t.Indexes)),
+			ForeignKeys: []*ForeignKey{},
+			Checks:      []*CheckConstraint{},
+			Uniques:     []*UniqueConstraint{},
+		}
+		if t.Desc != nil {
+			st.Desc.Parse(*t.Desc)
+		}
+		for j, v := range t.Columns {
+			if st.Columns[j], err = p.columnFromRow(v); err != nil {
+				return nil, fmt.Errorf("the table %q:%s", t.Name, err)
+			}
+		}
+		for j, v := range t.Indexes {
+			if st.Indexes[j], err = indexFromRow(v); err != nil {
+				return nil, fmt.Errorf("the table %q:%s", t.Name, err)
+			}
+		}
+		for _, v := range t.Constraints {
+			switch v["type"] {
+			case "f":
+				st.ForeignKeys = append(st.ForeignKeys, foreignKeyFromRow(v))
+			case "c":
+				st.Checks = append(st.Checks, checkFromRow(v))
+			case "u":
+				st.Uniques = append(st.Uniques, uniqueFromRow(v))
+			}
+		}
+		rev.Tables[i] = st
+	}
+	return rev, nil
+}
@@ -5,7 +5,7 @@ const (
 		SELECT
 		  a.attname as columnname,
 		  a.attnotnull as notnull,
-		  d.adsrc AS def,
+		  pg_get_expr(d.adbin, d.adrelid) AS def,
 		  pg_catalog.format_type(a.atttypid, a.atttypmod) AS datatype,
 		  col_description(b.oid,a.attnum) as desc
 		FROM
@@ -17,6 +17,30 @@ const (
 		  pg_catalog.pg_attrdef d ON (a.attrelid, a.attnum) = (d.adrelid,  d.adnum)
 		WHERE
 
+		  a.attnum > 0 AND
+		  NOT a.attisdropped
+		ORDER BY
+		  a.attnum`
+	// SQL_SchemaTableColumns is the columns of the table with the PostgreSQL attributes,
+	// $1 is the schema(empty means the current schema),$2 is the table
+	SQL_SchemaTableColumns = `
+		SELECT
+		  a.attname as column_name,
+		  a.attnotnull as notnull,
+		  pg_catalog.format_type(a.atttypid, a.atttypmod) AS data_type,
+		  pg_get_expr(d.adbin, d.adrelid) as column_default,
+		  a.attidentity as column_identity,
+		  pg_get_serial_sequence(b.oid::regclass::text, a.attname) as column_sequence,
+		  col_description(b.oid,a.attnum) as column_desc
+		FROM
+		  pg_catalog.pg_attribute a join
+		  (SELECT  c.oid
+		   FROM    pg_catalog.pg_class c LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		   WHERE c.relname =$2 AND (n.nspname) = coalesce(nullif($1,''),current_schema)
+		  ) b on a.attrelid = b.oid left join
+		  pg_catalog.pg_attrdef d ON (a.attrelid, a.attnum) = (d.adrelid,  d.adnum)
+		WHERE
+
 		  a.attnum > 0 AND
 		  NOT a.attisdropped
 		ORDER BY
@@ -24,13 +48,29 @@ const (
 	SQL_TableIndexes = `
 		select
 		  c.relname as indexname,
+		  i.indisunique as unique,
+		  am.amname as method,
 		  pg_get_indexdef(i.indexrelid) as define,
+		  coalesce(pg_get_expr(i.indpred, i.indrelid),'') as predicate,
 		  obj_description(c.oid) as desc
+		from
+		  pg_index i inner JOIN pg_class c ON c.oid = i.indexrelid
+		  inner JOIN pg_am am ON am.oid = c.relam
+		where
+		  indrelid = $1::regclass and
+		  indisprimary = false and
+		  not exists(select 1 from pg_constraint con where con.conindid = i.indexrelid and con.contype in ('u','x'))
+		order by
+		  c.relname`
+	SQL_TableInvalidIndexes = `
+		select
+		  c.relname as indexname
 		from
 		  pg_index i inner JOIN pg_class c ON c.oid = i.indexrelid
 		where
 		  indrelid = $1::regclass and
-		  indisprimary = false`
+		  not indisvalid and
+		  ($2 = '' or c.relname = $2)`
 	SQL_TablePrimaryKeys = `
 		SELECT
 		  pg_attribute.attname as columnname,
@@ -43,6 +83,82 @@ const (
 		  pg_index.indexrelid = idx.oid and
 		  pg_attribute.attnum = any(pg_index.indkey) AND
 		  indisprimary`
+	// SQL_UniqueKeyExists check the unique index that can be the arbiter of the ON CONFLICT,
+	// $1 is the table,$2 is the comma separated key columns
+	SQL_UniqueKeyExists = `
+		SELECT EXISTS(
+		  SELECT 1
+		  FROM pg_index i
+		  WHERE
+		    i.indrelid = $1::regclass AND
+		    i.indisunique AND
+		    i.indisvalid AND
+		    i.indimmediate AND
+		    i.indpred IS NULL AND
+		    i.indexprs IS NULL AND
+		    (SELECT array_agg(a.attname::text ORDER BY a.attname::text)
+		     FROM pg_attribute a
+		     WHERE a.attrelid = i.indrelid AND a.attnum = any(i.indkey)) =
+		    (SELECT array_agg(v ORDER BY v) FROM unnest(string_to_array($2, ',')) v)
+		)`
+	// SQL_ColumnDependents is the indexes and constraints depend on the column,$1 is the table,$2 is the column
+	SQL_ColumnDependents = `
+		SELECT DISTINCT coalesce(c.conname, i.relname) as name
+		FROM pg_depend d
+		  JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		  LEFT JOIN pg_constraint c ON d.classid = 'pg_constraint'::regclass AND c.oid = d.objid AND c.contype <> 'n'
+		  LEFT JOIN pg_class i ON d.classid = 'pg_class'::regclass AND i.oid = d.objid AND i.relkind = 'i'
+		WHERE
+		  d.refclassid = 'pg_class'::regclass AND
+		  d.refobjid = $1::regclass AND
+		  a.attname = $2 AND
+		  (c.oid IS NOT NULL OR i.oid IS NOT NULL)
+		ORDER BY 1`
+	SQL_TableForeignKeys = `
+		SELECT
+		  c.conname as name,
+		  array_to_string(array(
+		    SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY k(attnum,ord)
+		    JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+		    ORDER BY k.ord),',') as columns,
+		  case when rn.nspname = current_schema then '' else rn.nspname end as ref_schema,
+		  rt.relname as ref_table,
+		  array_to_string(array(
+		    SELECT a.attname FROM unnest(c.confkey) WITH ORDINALITY k(attnum,ord)
+		    JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum
+		    ORDER BY k.ord),',') as ref_columns,
+		  c.confdeltype::text as on_delete,
+		  c.confupdtype::text as on_update,
+		  c.condeferrable as deferrable,
+		  c.condeferred as deferred,
+		  c.convalidated as validated
+		FROM
+		  pg_constraint c JOIN
+		  pg_class rt ON rt.oid = c.confrelid JOIN
+		  pg_namespace rn ON rn.oid = rt.relnamespace
+		WHERE
+		  c.conrelid = $1::regclass AND
+		  c.contype = 'f'
+		ORDER BY
+		  c.conname`
+	SQL_TableConstraints = `
+		SELECT
+		  c.conname as name,
+		  array_to_string(array(
+		    SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY k(attnum,ord)
+		    JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+		    ORDER BY k.ord),',') as columns,
+		  coalesce(pg_get_expr(c.conbin, c.conrelid),'') as expression,
+		  c.condeferrable as deferrable,
+		  c.condeferred as deferred,
+		  c.convalidated as validated
+		FROM
+		  pg_constraint c
+		WHERE
+		  c.conrelid = $1::regclass AND
+		  c.contype = $2
+		ORDER BY
+		  c.conname`
 	SQL_TableExists = `
 	SELECT EXISTS(
 	    SELECT *
@@ -51,9 +167,118 @@ const (
 	      table_schema = current_schema AND
 	      table_name = $1
 	)`
+	// SQL_SchemaTableExists is the SQL_TableExists with $1 is the schema(empty means the current schema),$2 is the table
+	SQL_SchemaTableExists = `
+	SELECT EXISTS(
+	    SELECT *
+	    FROM information_schema.tables
+	    WHERE
+	      table_schema = coalesce(nullif($1,''),current_schema) AND
+	      table_name = $2
+	)`
+	SQL_GetSchema = `
+		WITH ns AS (
+		  SELECT b.oid,b.nspname,a.description
+		  FROM pg_namespace b left join pg_description a on a.objoid = b.oid AND a.classoid = 'pg_namespace'::regclass
+		  WHERE b.nspname=coalesce(nullif($1,''),current_schema)
+		)
+		SELECT json_build_object(
+		  'name', ns.nspname,
+		  'desc', ns.description,
+		  'tables', (
+		    SELECT json_agg(json_build_object(
+		      'name', t.relname,
+		      'desc', obj_description(t.oid,'pg_class'),
+		      'columns', (
+		        SELECT json_agg(json_build_object(
+		          'column_name', a.attname,
+		          'notnull', a.attnotnull,
+		          'data_type', pg_catalog.format_type(a.atttypid, a.atttypmod),
+		          'column_default', pg_get_expr(d.adbin, d.adrelid),
+		          'column_identity', a.attidentity,
+		          'column_sequence', pg_get_serial_sequence(t.oid::regclass::text, a.attname),
+		          'column_desc', col_description(t.oid,a.attnum)
+		        ) ORDER BY a.attnum)
+		        FROM
+		          pg_catalog.pg_attribute a left join
+		          pg_catalog.pg_attrdef d ON (a.attrelid, a.attnum) = (d.adrelid,  d.adnum)
+		        WHERE a.attrelid = t.oid AND a.attnum > 0 AND NOT a.attisdropped
+		      ),
+		      'pk', (
+		        SELECT json_agg(a.attname ORDER BY k.ord)
+		        FROM
+		          pg_index i CROSS JOIN unnest(i.indkey::int2[]) WITH ORDINALITY k(attnum,ord) JOIN
+		          pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		        WHERE i.indrelid = t.oid AND i.indisprimary
+		      ),
+		      'indexes', (
+		        SELECT json_agg(json_build_object(
+		          'indexname', c.relname,
+		          'unique', i.indisunique,
+		          'method', am.amname,
+		          'define', pg_get_indexdef(i.indexrelid),
+		          'predicate', coalesce(pg_get_expr(i.indpred, i.indrelid),''),
+		          'desc', obj_description(c.oid,'pg_class')
+		        ) ORDER BY c.relname)
+		        FROM
+		          pg_index i inner JOIN pg_class c ON c.oid = i.indexrelid
+		          inner JOIN pg_am am ON am.oid = c.relam
+		        WHERE
+		          i.indrelid = t.oid AND
+		          i.indisprimary = false AND
+		          not exists(select 1 from pg_constraint con where con.conindid = i.indexrelid and con.contype in ('u','x'))
+		      ),
+		      'constraints', (
+		        SELECT json_agg(json_build_object(
+		          'type', c.contype,
+		          'name', c.conname,
+		          'columns', array_to_string(array(
+		            SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY k(attnum,ord)
+		            JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+		            ORDER BY k.ord),','),
+		          'expression', coalesce(pg_get_expr(c.conbin, c.conrelid),''),
+		          'ref_schema', case when rn.nspname = ns.nspname then '' else rn.nspname end,
+		          'ref_table', rt.relname,
+		          'ref_columns', array_to_string(array(
+		            SELECT a.attname FROM unnest(c.confkey) WITH ORDINALITY k(attnum,ord)
+		            JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum
+		            ORDER BY k.ord),','),
+		          'on_delete', c.confdeltype::text,
+		          'on_update', c.confupdtype::text,
+		          'deferrable', c.condeferrable,
+		          'deferred', c.condeferred,
+		          'validated', c.convalidated
+		        ) ORDER BY c.conname)
+		        FROM
+		          pg_constraint c LEFT JOIN
+		          pg_class rt ON rt.oid = c.confrelid LEFT JOIN
+		          pg_namespace rn ON rn.oid = rt.relnamespace
+		        WHERE c.conrelid = t.oid AND c.contype in ('f','c','u')
+		      )
+		    ) ORDER BY t.relname)
+		    FROM pg_class t
+		    WHERE t.relnamespace = ns.oid AND t.relkind in ('r','p')
+		  )
+		)::text as schema
+		FROM ns`
+	SQL_CopyOutColumns = `
+		SELECT
+		  t.typoutput::regproc::text as output,
+		  t.typsend::regproc::text as send
+		FROM
+		  unnest((
+		    SELECT ARRAY[%s]::regtype[]
+		    FROM (SELECT 1) d LEFT JOIN (SELECT * FROM (%s
+		    ) q LIMIT 0) q(%s) ON true
+		  )) WITH ORDINALITY c(typ,no) join pg_catalog.pg_type t on t.oid = c.typ
+		ORDER BY
+		  c.no`
 	SQL_GetTableDesc            = "select obj_description($1::regclass,'pg_class')"
 	SQL_GetCurrentSchemaAndDesc = "SELECT b.nspname,a.description FROM pg_namespace b left join pg_description a on a.objoid = b.oid WHERE b.nspname=current_schema"
 	SQL_GetTableCheck           = "select id,displaylabel,level,fields,script,grade from lx_check where tablename=$1"
+	SQL_UpdateTableCheck        = "update lx_check set displaylabel=$3,level=$4,fields=$5,script=$6,grade=$7 where tablename=$1 and id=$2"
+	SQL_InsertTableCheck        = "insert into lx_check(tablename,id,displaylabel,level,fields,script,grade) values($1,$2,$3,$4,$5,$6,$7)"
+	SQL_DeleteTableCheck        = "delete from lx_check where tablename=$1 and id=$2"
 
 	SQL_DropConstraint    = "ALTER TABLE %v DROP CONSTRAINT %v"
 	SQL_CreatePrimaryKey  = "ALTER TABLE %v ADD PRIMARY KEY(%v)"
@@ -75,4 +300,6 @@ const (
 	SQL_DropTable         = "DROP TABLE %s"
 	SQL_CreateSchema      = "CREATE ROLE %s LOGIN PASSWORD %s NOSUPERUSER INHERIT NOCREATEDB NOCREATEROLE NOREPLICATION;CREATE SCHEMA %s AUTHORIZATION %s;"
 	SQL_DropSchema        = "DROP SCHEMA %s;DROP ROLE %s;"
+
+	SQL_ValidateConstraint = "ALTER TABLE %v VALIDATE CONSTRAINT %v"
 )
@@ -0,0 +1,37 @@
+package pghelper
+
+import (
+	"github.com/linlexing/dbhelper"
+)
+
+// Table is the table define with the PostgreSQL column attributes
+type Table struct {
+	Name      string
+	Columns   []*Column
+	PK        []string
+	Temporary bool
+	Desc      dbhelper.DBDesc
+}
+
+// NewTable build the table define from the DataTable
+func NewTable(table *dbhelper.DataTable) *Table {
+	rev := &Table{
+		Name:      table.TableName,
+		Columns:   make([]*Column, len(table.Columns)),
+		Temporary: table.Temporary,
+		Desc:      table.Desc,
+	}
+	for i, c := range table.Columns {
+		rev.Columns[i] = NewColumn(&dbhelper.TableColumn{
+			Name:    c.Name,
+			Type:    c.DataType,
+			MaxSize: c.MaxSize,
+			NotNull: c.NotNull,
+			Desc:    c.Desc,
+		})
+	}
+	if table.HasPrimaryKey() {
+		rev.PK = table.PK
+	}
+	return rev
+}
@@ -0,0 +1,164 @@
+package pghelper
+
+import (
+	"fmt"
+	"github.com/linlexing/datatable.go"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TypeDefine build the column type of the create/alter statement from the max size
+// and the type modifiers(precision,scale),the modifiers may be empty
+type TypeDefine func(maxSize int, modifiers []int) string
+
+// TypeMapping describe how a catalog type is mapped to the datatable type
+type TypeMapping struct {
+	Type datatable.ColumnType
+	// SizeFromModifier means the first type modifier is the MaxSize,e.g. character varying(50)
+	SizeFromModifier bool
+}
+
+// TypeRegistry map the PostgreSQL catalog types to the datatable types in both directions.
+// The catalog type is the base name returned by format_type without the modifiers,
+// e.g. "numeric" for "numeric(12,2)"
+type TypeRegistry struct {
+	lock     sync.RWMutex
+	mappings map[string]TypeMapping
+	defines  map[datatable.ColumnType]TypeDefine
+	// Fallback is used when the catalog type is not registered,
+	// so introspecting a table never fails on the unknown types
+	Fallback datatable.ColumnType
+}
+
+var regTypeModifier = regexp.MustCompile(`\(([\d\s,]+)\)`)
+
+// defaultTypes is used by the PgMeta without the Types,e.g. created as the struct literal
+var defaultTypes = NewTypeRegistry()
+
+// types return the Types of the PgMeta,the default registry if not set
+func (p *PgMeta) types() *TypeRegistry {
+	if p.Types == nil {
+		return defaultTypes
+	}
+	return p.Types
+}
+
+// NewTypeRegistry return the registry with the builtin types registered
+func NewTypeRegistry() *TypeRegistry {
+	rev := &TypeRegistry{
+		mappings: map[string]TypeMapping{},
+		defines:  map[datatable.ColumnType]TypeDefine{},
+		Fallback: datatable.String,
+	}
+	for _, v := range []string{"text", "name", "\"char\"", "uuid", "json", "jsonb", "xml", "inet", "cidr",
+		"macaddr", "interval", "time without time zone", "time with time zone", "money", "citext", "tsvector"} {
+		rev.Register(v, TypeMapping{Type: datatable.String})
+	}
+	rev.Register("character varying", TypeMapping{Type: datatable.String, SizeFromModifier: true})
+	rev.Register("character", TypeMapping{Type: datatable.String, SizeFromModifier: true})
+	rev.Register("boolean", TypeMapping{Type: datatable.Bool})
+	for _, v := range []string{"smallint", "integer", "bigint"} {
+		rev.Register(v, TypeMapping{Type: datatable.Int64})
+	}
+	for _, v := range []string{"real", "double precision", "numeric"} {
+		rev.Register(v, TypeMapping{Type: datatable.Float64})
+	}
+	for _, v := range []string{"timestamp without time zone", "timestamp with time zone", "date"} {
+		rev.Register(v, TypeMapping{Type: datatable.Time})
+	}
+	rev.Register("bytea", TypeMapping{Type: datatable.Bytea})
+
+	rev.RegisterDefine(datatable.String, func(maxSize int, _ []int) string {
+		if maxSize > 0 {
+			return fmt.Sprintf("character varying(%d)", maxSize)
+		}
+		return "text"
+	})
+	rev.RegisterDefine(datatable.Bool, func(int, []int) string { return "boolean" })
+	rev.RegisterDefine(datatable.Int64, func(int, []int) string { return "bigint" })
+	rev.RegisterDefine(datatable.Float64, func(_ int, modifiers []int) string {
+		switch len(modifiers) {
+		case 0:
+			return "double precision"
+		case 1:
+			return fmt.Sprintf("numeric(%d)", modifiers[0])
+		default:
+			return fmt.Sprintf("numeric(%d,%d)", modifiers[0], modifiers[1])
+		}
+	})
+	rev.RegisterDefine(datatable.Time, func(_ int, modifiers []int) string {
+		if len(modifiers) > 0 {
+			return fmt.Sprintf("timestamp(%d) without time zone", modifiers[0])
+		}
+		return "timestamp without time zone"
+	})
+	rev.RegisterDefine(datatable.Bytea, func(int, []int) string { return "bytea" })
+	return rev
+}
+
+// Register add or replace the mapping of the catalog type
+func (r *TypeRegistry) Register(dbType string, mapping TypeMapping) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.mappings[dbType] = mapping
+}
+
+// RegisterDefine add or replace the column type used to create the datatable type
+func (r *TypeRegistry) RegisterDefine(dataType datatable.ColumnType, define TypeDefine) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.defines[dataType] = define
+}
+
+// Define return the column type of the datatable type,panic if not registered.
+// the modifiers are the precision and scale,e.g. numeric(12,2) or timestamp(3)
+func (r *TypeRegistry) Define(dataType datatable.ColumnType, maxSize int, modifiers ...int) string {
+	r.lock.RLock()
+	define, ok := r.defines[dataType]
+	r.lock.RUnlock()
+	if !ok {
+		panic(fmt.Errorf("the type %s invalid", dataType))
+	}
+	return define(maxSize, modifiers)
+}
+
+// Parse map the format_type output to the datatable type,
+// return the max size and the all type modifiers(precision,scale...)
+func (r *TypeRegistry) Parse(dbType string) (dataType datatable.ColumnType, maxSize int, modifiers []int, err error) {
+	base, modifiers, err := splitTypeModifier(dbType)
+	if err != nil {
+		return
+	}
+	r.lock.RLock()
+	mapping, ok := r.mappings[base]
+	r.lock.RUnlock()
+	if !ok {
+		dataType = r.Fallback
+		return
+	}
+	dataType = mapping.Type
+	if mapping.SizeFromModifier && len(modifiers) > 0 {
+		maxSize = modifiers[0]
+	}
+	return
+}
+
+// splitTypeModifier split "numeric(12,2)" to "numeric" and [12 2],
+// "timestamp(3) without time zone" to "timestamp without time zone" and [3]
+func splitTypeModifier(dbType string) (string, []int, error) {
+	m := regTypeModifier.FindStringSubmatchIndex(dbType)
+	if m == nil {
+		return dbType, nil, nil
+	}
+	strs := strings.Split(dbType[m[2]:m[3]], ",")
+	modifiers := make([]int, len(strs))
+	for i, v := range strs {
+		var err error
+		if modifiers[i], err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+			return "", nil, err
+		}
+	}
+	return dbType[:m[0]] + dbType[m[1]:], modifiers, nil
+}